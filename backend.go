@@ -19,18 +19,20 @@ package dockerregistry
 
 import (
 	"context"
+	"net/http"
 	"strings"
 	"sync"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/time/rate"
 )
 
 // Factory build and initialize the docker-registry secret engine logical backend.
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
-	registryClient := NewRegistryClient()
-	b := newBackend(registryClient)
+	b := newBackend(NewRegistryClient)
 	if err := b.Setup(ctx, conf); err != nil {
 		return nil, err
 	}
@@ -40,11 +42,56 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 
 // -----------------------------------------------------------------------------
 
+// registryClientFactory builds a registry client from an HTTP client.
+type registryClientFactory func(*http.Client) RegistryClient
+
 type backend struct {
 	*framework.Backend
+
+	// RWMutex guards the decoded config and roles snapshot, which spares
+	// storage reads on the hot path. Writes update it, invalidate drops it.
+	// snapshotGen prevents a load started before a change from storing a
+	// stale entry.
 	sync.RWMutex
+	config      *Config
+	roles       map[string]*Role
+	snapshotGen uint64
+
+	// client is rebuilt by newClient when the transport settings identified
+	// by clientFingerprint change.
+	client            RegistryClient
+	clientFingerprint string
+	clientLock        sync.Mutex
+	newClient         registryClientFactory
+
+	// catalogCache holds, by registry and credentials, the repositories used
+	// to expand repository scope patterns. catalogFlights merges concurrent
+	// listings of the same catalog, catalogGen discards the listings started
+	// before a reset.
+	catalogCache   map[string]*cachedCatalog
+	catalogFlights map[string]*catalogFlight
+	catalogGen     uint64
+	catalogLock    sync.Mutex
+
+	// limiter enforces the mount upstream request budget, nil when disabled.
+	limiter     *rate.Limiter
+	limiterLock sync.Mutex
 
-	client RegistryClient
+	// tokenFlights merges identical concurrent token requests.
+	tokenFlights tokenFlightGroup
+
+	// tokenCache shares registry tokens between requests of cache enabled
+	// roles.
+	tokenCache tokenCache
+
+	// quotaLock serializes quota counter updates.
+	quotaLock sync.Mutex
+
+	// configLock serializes the configuration read-modify-write cycles.
+	configLock sync.Mutex
+
+	// rotationLock serializes registry credential rotations.
+	rotationLock sync.Mutex
 
 	// ctx and ctxCancel are used to control overall plugin shutdown. These
 	// contexts are given to any client libraries or requests that should be
@@ -54,7 +101,7 @@ type backend struct {
 	ctxLock   sync.Mutex
 }
 
-func newBackend(client RegistryClient) *backend {
+func newBackend(newClient registryClientFactory) *backend {
 	var b backend
 
 	b.ctx, b.ctxCancel = context.WithCancel(context.Background())
@@ -70,18 +117,30 @@ func newBackend(client RegistryClient) *backend {
 			SealWrapStorage: []string{
 				"config",
 				"roles/*",
+				rotationPendingPath,
 			},
 		},
 		Paths: framework.PathAppend(
 			b.pathConfig(),
+			b.pathConfigStatus(),
+			b.pathConfigRateLimit(),
 			b.pathListRoles(),
 			b.pathRoles(),
 			b.pathCreds(),
+			b.pathCredsBatch(),
+			b.pathRotateRoot(),
+			b.pathRegistry(),
+			b.pathTools(),
 		),
+		Secrets: []*framework.Secret{
+			b.secretToken(),
+		},
 
-		Clean: b.clean,
+		PeriodicFunc: b.periodicFunc,
+		Invalidate:   b.invalidate,
+		Clean:        b.clean,
 	}
-	b.client = client
+	b.newClient = newClient
 
 	return &b
 }
@@ -94,28 +153,120 @@ func (b *backend) clean(_ context.Context) {
 	b.ctxLock.Unlock()
 }
 
+// invalidate drops the in-memory state derived from a storage entry changed
+// by another node.
+func (b *backend) invalidate(_ context.Context, key string) {
+	switch {
+	case key == "config":
+		b.setConfig(nil)
+		b.resetCatalog()
+		b.tokenCache.reset()
+	case strings.HasPrefix(key, rolesPath+"/"):
+		roleName := strings.TrimPrefix(key, rolesPath+"/")
+		b.setRole(roleName, nil)
+		b.tokenCache.dropRole(roleName)
+	}
+}
+
+// periodicFunc runs the scheduled tasks. Tasks writing to storage are only run
+// on the primary active node.
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	if err := b.periodicRefreshTokenCache(ctx, req.Storage); err != nil {
+		b.Logger().Error("cached registry token refresh failed", "error", err)
+	}
+
+	replicationState := b.System().ReplicationState()
+	if b.System().LocalMount() || !replicationState.HasState(consts.ReplicationPerformanceSecondary|consts.ReplicationPerformanceStandby) {
+		if err := b.periodicRotateRoot(ctx, req.Storage); err != nil {
+			b.Logger().Error("scheduled registry credential rotation failed", "error", err)
+		}
+		if err := b.periodicHealthCheck(ctx, req.Storage); err != nil {
+			b.Logger().Error("scheduled registry credential health check failed", "error", err)
+		}
+		if err := b.periodicPruneQuotas(ctx, req.Storage); err != nil {
+			b.Logger().Error("expired quota counters cleanup failed", "error", err)
+		}
+	}
+
+	return nil
+}
+
 // -----------------------------------------------------------------------------
 
 // Config parses and returns the configuration data from the storage backend.
 // Even when no user-defined data exists in storage, a Config is returned with
-// the default values.
+// the default values. The decoded configuration is kept in the snapshot, each
+// caller gets its own copy.
 func (b *backend) Config(ctx context.Context, s logical.Storage) (*Config, error) {
+	b.RLock()
+	cached, gen := b.config, b.snapshotGen
+	b.RUnlock()
+	if cached != nil {
+		return cached.clone(), nil
+	}
+
 	c := DefaultConfig()
 
 	entry, err := s.Get(ctx, "config")
 	if err != nil {
 		return nil, errwrap.Wrapf("failed to get configuration from storage: {{err}}", err)
 	}
-	if entry == nil || len(entry.Value) == 0 {
-		return c, nil
+	if entry != nil && len(entry.Value) > 0 {
+		if err := entry.DecodeJSON(&c); err != nil {
+			return nil, errwrap.Wrapf("failed to decode configuration: {{err}}", err)
+		}
 	}
 
-	if err := entry.DecodeJSON(&c); err != nil {
-		return nil, errwrap.Wrapf("failed to decode configuration: {{err}}", err)
+	// Keep the snapshot unless it changed meanwhile
+	b.Lock()
+	if b.snapshotGen == gen {
+		b.config = c.clone()
 	}
+	b.Unlock()
+
 	return c, nil
 }
 
+// setConfig replaces the configuration snapshot after a write, nil drops it.
+func (b *backend) setConfig(c *Config) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.snapshotGen++
+	b.config = nil
+	if c != nil {
+		b.config = c.clone()
+	}
+}
+
+// Client returns the registry client matching the configuration transport
+// settings. The client is rebuilt when these settings change.
+func (b *backend) Client(c *Config) (RegistryClient, error) {
+	b.updateUpstreamLimiter(c)
+	fingerprint := c.TransportConfig.Fingerprint()
+
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	if b.client != nil && b.clientFingerprint == fingerprint {
+		return b.client, nil
+	}
+
+	// Build a new HTTP client
+	httpClient, err := c.TransportConfig.HTTPClient()
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to build registry http client: {{err}}", err)
+	}
+
+	b.client = &budgetedClient{
+		RegistryClient: b.newClient(httpClient),
+		limiter:        b.upstreamLimiter,
+	}
+	b.clientFingerprint = fingerprint
+
+	return b.client, nil
+}
+
 // -----------------------------------------------------------------------------
 
 const backendHelp = `
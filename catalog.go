@@ -0,0 +1,175 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/zntrio/vault-plugin-secrets-docker-registry/scope"
+)
+
+// cachedCatalog is a registry catalog listing.
+type cachedCatalog struct {
+	repositories []string
+	listedAt     time.Time
+}
+
+// catalogFlight is a catalog listing shared by concurrent requests.
+type catalogFlight struct {
+	done         chan struct{}
+	repositories []string
+	err          error
+}
+
+// catalogKey identifies the catalog seen by the engine registry identity.
+func catalogKey(engine *Config) string {
+	h := sha256.New()
+	for _, v := range []string{engine.RegistryURL, engine.EndpointURL, engine.TokenFlow, engine.ClientID, engine.Username, engine.Password, engine.RefreshToken} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedCatalog returns the registry repositories, listed again when the
+// cached listing is older than the configured refresh interval. The listing
+// runs outside the cache lock, shared by the concurrent requests.
+func (b *backend) cachedCatalog(ctx context.Context, engine *Config, client RegistryClient) ([]string, error) {
+	key := catalogKey(engine)
+
+	b.catalogLock.Lock()
+	cc, ok := b.catalogCache[key]
+	hit := ok && time.Since(cc.listedAt) < engine.CatalogRefreshInterval
+	emitCache(cacheCatalog, hit)
+	if hit {
+		b.catalogLock.Unlock()
+		return cc.repositories, nil
+	}
+
+	f, listing := b.catalogFlights[key]
+	if !listing {
+		f = &catalogFlight{
+			done: make(chan struct{}),
+		}
+		if b.catalogFlights == nil {
+			b.catalogFlights = map[string]*catalogFlight{}
+		}
+		b.catalogFlights[key] = f
+		gen := b.catalogGen
+
+		// A caller leaving does not cancel the listing for the others
+		go func() {
+			f.repositories, f.err = b.catalog(b.ctx, engine, client)
+
+			b.catalogLock.Lock()
+			if b.catalogFlights[key] == f {
+				delete(b.catalogFlights, key)
+			}
+			if f.err == nil && b.catalogGen == gen {
+				if b.catalogCache == nil {
+					b.catalogCache = map[string]*cachedCatalog{}
+				}
+				b.catalogCache[key] = &cachedCatalog{
+					repositories: f.repositories,
+					listedAt:     time.Now(),
+				}
+			}
+			b.catalogLock.Unlock()
+			close(f.done)
+		}()
+	}
+	b.catalogLock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-f.done:
+	}
+
+	return f.repositories, f.err
+}
+
+// resetCatalog drops the cached registry catalogs, and the listings in
+// progress.
+func (b *backend) resetCatalog() {
+	b.catalogLock.Lock()
+	b.catalogCache = nil
+	b.catalogFlights = nil
+	b.catalogGen++
+	b.catalogLock.Unlock()
+}
+
+// expandScopes replaces the repository scope patterns by the matching
+// repositories of the registry catalog. It returns the concrete scopes and
+// the repositories matched by each pattern, nil when there is no pattern. A
+// pattern matching no repository is rejected.
+func (b *backend) expandScopes(ctx context.Context, engine *Config, client RegistryClient, scopes []string) ([]string, map[string][]string, error) {
+	parsed, err := scope.ParseList(scopes)
+	if err != nil {
+		return nil, nil, logical.CodedError(http.StatusBadRequest, err.Error())
+	}
+
+	hasPattern := false
+	for _, s := range parsed {
+		if s.IsPattern() {
+			hasPattern = true
+			break
+		}
+	}
+	if !hasPattern {
+		return scopes, nil, nil
+	}
+
+	repositories, err := b.cachedCatalog(ctx, engine, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	concrete := []*scope.Scope{}
+	expanded := map[string][]string{}
+	matched := map[string]bool{}
+	for _, s := range parsed {
+		if !s.IsPattern() {
+			concrete = append(concrete, s)
+			continue
+		}
+
+		names := []string{}
+		for _, e := range s.Expand(repositories) {
+			names = append(names, e.Name)
+			matched[e.Name] = true
+			concrete = append(concrete, e)
+		}
+		if len(names) == 0 {
+			return nil, nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("repository scope pattern %q does not match any repository", s.Name))
+		}
+		expanded[s.Name] = names
+
+		if len(matched) > engine.MaxScopeExpansion {
+			return nil, nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("repository scope patterns expand to more than %d repositories", engine.MaxScopeExpansion))
+		}
+	}
+
+	return scope.Strings(scope.Normalize(concrete)), expanded, nil
+}
@@ -0,0 +1,100 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestCredsPatternExpansion(t *testing.T) {
+	r := newTestRegistry(t)
+	r.repositories = []string{"team-a/api", "team-a/web", "team-b/api"}
+	b, s, _ := testBackend(t, r, nil)
+
+	testRequest(t, b, s, logical.CreateOperation, "roles/team-a", map[string]interface{}{
+		"scopes": []string{"repository:team-a/*:pull"},
+	})
+
+	// Concurrent cold reads share a single listing, done outside the lock
+	gate := make(chan struct{})
+	r.mu.Lock()
+	r.catalogGate = gate
+	r.mu.Unlock()
+
+	const readers = 4
+	responses := make([]*logical.Response, readers)
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = testRequest(t, b, s, logical.ReadOperation, "creds/team-a", nil)
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	want := map[string][]string{"team-a/*": {"team-a/api", "team-a/web"}}
+	for i, resp := range responses {
+		if got := resp.Data["expanded_repositories"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("reader %d expanded_repositories = %#v, want %#v", i, got, want)
+		}
+	}
+	if _, catalogs := r.counters(); catalogs != 1 {
+		t.Errorf("catalog listed %d times, want 1", catalogs)
+	}
+
+	// Cached listing
+	testRequest(t, b, s, logical.ReadOperation, "creds/team-a", nil)
+	if _, catalogs := r.counters(); catalogs != 1 {
+		t.Errorf("catalog listed %d times after a cache hit, want 1", catalogs)
+	}
+
+	// Patterns matching nothing are rejected
+	testRequest(t, b, s, logical.CreateOperation, "roles/team-c", map[string]interface{}{
+		"scopes": []string{"repository:team-c/*:pull"},
+	})
+	resp, err := testHandle(b, s, logical.ReadOperation, "creds/team-c", nil)
+	if code := testErrorCode(resp, err); code != http.StatusBadRequest {
+		t.Errorf("creds of a pattern matching nothing: %d, %v, want a 400", code, err)
+	}
+}
+
+func TestCatalogKey(t *testing.T) {
+	engine := DefaultConfig()
+	engine.Username, engine.Password = "robot", "secret"
+
+	other := *engine
+	other.Username = "other"
+	if catalogKey(engine) == catalogKey(&other) {
+		t.Error("catalogs listed with different credentials share the same key")
+	}
+
+	same := *engine
+	same.CatalogRefreshInterval = time.Hour
+	if catalogKey(engine) != catalogKey(&same) {
+		t.Error("catalogs listed with the same identity have different keys")
+	}
+}
@@ -0,0 +1,157 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	challengeSchemeBearer = "bearer"
+	challengeSchemeBasic  = "basic"
+)
+
+// AuthChallenge represents a parsed WWW-Authenticate challenge returned by a
+// registry API endpoint.
+type AuthChallenge struct {
+	Scheme     string
+	Realm      string
+	Service    string
+	Parameters map[string]string
+}
+
+// IsBearer returns true if the challenge requests a bearer token.
+func (ac *AuthChallenge) IsBearer() bool {
+	return ac != nil && ac.Scheme == challengeSchemeBearer
+}
+
+// parseAuthChallenges decodes all challenges from WWW-Authenticate header
+// values.
+func parseAuthChallenges(headers []string) ([]*AuthChallenge, error) {
+	challenges := []*AuthChallenge{}
+	for _, h := range headers {
+		c, err := parseAuthChallengeHeader(h)
+		if err != nil {
+			return nil, err
+		}
+		challenges = append(challenges, c...)
+	}
+
+	return challenges, nil
+}
+
+// parseAuthChallengeHeader decodes a WWW-Authenticate header value as
+// described in RFC 7235, a single header value can hold several challenges.
+func parseAuthChallengeHeader(header string) ([]*AuthChallenge, error) {
+	var (
+		challenges []*AuthChallenge
+		current    *AuthChallenge
+	)
+
+	s := strings.TrimSpace(header)
+	for s != "" {
+		// Read the next token
+		token, rest := readChallengeToken(s)
+		if token == "" {
+			return nil, fmt.Errorf("invalid authentication challenge %q", header)
+		}
+		rest = strings.TrimLeft(rest, " \t")
+
+		if !strings.HasPrefix(rest, "=") {
+			// Token is a new authentication scheme
+			current = &AuthChallenge{
+				Scheme:     strings.ToLower(token),
+				Parameters: map[string]string{},
+			}
+			challenges = append(challenges, current)
+			s = strings.TrimLeft(rest, " \t,")
+			continue
+		}
+
+		// Token is a parameter name of the current challenge
+		if current == nil {
+			return nil, fmt.Errorf("invalid authentication challenge %q: parameter without scheme", header)
+		}
+
+		value, rest, err := readChallengeValue(strings.TrimLeft(rest[1:], " \t"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid authentication challenge %q: %v", header, err)
+		}
+		current.Parameters[strings.ToLower(token)] = value
+
+		s = strings.TrimLeft(rest, " \t,")
+	}
+
+	// Extract well-known parameters
+	for _, c := range challenges {
+		c.Realm = c.Parameters["realm"]
+		c.Service = c.Parameters["service"]
+	}
+
+	return challenges, nil
+}
+
+func readChallengeToken(s string) (string, string) {
+	i := strings.IndexAny(s, " \t,=")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+func readChallengeValue(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		i := strings.IndexAny(s, " \t,")
+		if i < 0 {
+			return s, "", nil
+		}
+		return s[:i], s[i:], nil
+	}
+
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i < len(s) {
+				sb.WriteByte(s[i])
+			}
+		case '"':
+			return sb.String(), s[i+1:], nil
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+
+	return "", "", errors.New("unterminated quoted string")
+}
+
+// selectAuthChallenge returns the preferred challenge, bearer first.
+func selectAuthChallenge(challenges []*AuthChallenge) *AuthChallenge {
+	for _, c := range challenges {
+		if c.IsBearer() {
+			return c
+		}
+	}
+	if len(challenges) > 0 {
+		return challenges[0]
+	}
+	return nil
+}
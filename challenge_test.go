@@ -0,0 +1,188 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAuthChallengeHeader(t *testing.T) {
+	testCases := []struct {
+		name    string
+		header  string
+		want    []*AuthChallenge
+		wantErr bool
+	}{
+		{
+			name:   "docker hub",
+			header: `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`,
+			want: []*AuthChallenge{
+				{
+					Scheme:  "bearer",
+					Realm:   "https://auth.docker.io/token",
+					Service: "registry.docker.io",
+					Parameters: map[string]string{
+						"realm":   "https://auth.docker.io/token",
+						"service": "registry.docker.io",
+						"scope":   "repository:library/alpine:pull",
+					},
+				},
+			},
+		},
+		{
+			name:   "ghcr",
+			header: `Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:user/image:pull"`,
+			want: []*AuthChallenge{
+				{
+					Scheme:  "bearer",
+					Realm:   "https://ghcr.io/token",
+					Service: "ghcr.io",
+					Parameters: map[string]string{
+						"realm":   "https://ghcr.io/token",
+						"service": "ghcr.io",
+						"scope":   "repository:user/image:pull",
+					},
+				},
+			},
+		},
+		{
+			name:   "harbor",
+			header: `Bearer realm="https://harbor.example.com/service/token",service="harbor-registry"`,
+			want: []*AuthChallenge{
+				{
+					Scheme:  "bearer",
+					Realm:   "https://harbor.example.com/service/token",
+					Service: "harbor-registry",
+					Parameters: map[string]string{
+						"realm":   "https://harbor.example.com/service/token",
+						"service": "harbor-registry",
+					},
+				},
+			},
+		},
+		{
+			name:   "basic",
+			header: `Basic realm="Registry Realm"`,
+			want: []*AuthChallenge{
+				{
+					Scheme: "basic",
+					Realm:  "Registry Realm",
+					Parameters: map[string]string{
+						"realm": "Registry Realm",
+					},
+				},
+			},
+		},
+		{
+			name:   "several challenges",
+			header: `Basic realm="registry", Bearer realm="https://auth.example.com/token", service=registry.example.com`,
+			want: []*AuthChallenge{
+				{
+					Scheme:     "basic",
+					Realm:      "registry",
+					Parameters: map[string]string{"realm": "registry"},
+				},
+				{
+					Scheme:  "bearer",
+					Realm:   "https://auth.example.com/token",
+					Service: "registry.example.com",
+					Parameters: map[string]string{
+						"realm":   "https://auth.example.com/token",
+						"service": "registry.example.com",
+					},
+				},
+			},
+		},
+		{
+			name:   "case and escapes",
+			header: `BEARER Realm = "https://auth.example.com/t\"oken" , Service="svc"`,
+			want: []*AuthChallenge{
+				{
+					Scheme:  "bearer",
+					Realm:   `https://auth.example.com/t"oken`,
+					Service: "svc",
+					Parameters: map[string]string{
+						"realm":   `https://auth.example.com/t"oken`,
+						"service": "svc",
+					},
+				},
+			},
+		},
+		{
+			name:   "scheme only",
+			header: "Bearer",
+			want: []*AuthChallenge{
+				{Scheme: "bearer", Parameters: map[string]string{}},
+			},
+		},
+		{
+			name:   "empty",
+			header: "   ",
+		},
+		{
+			name:    "parameter without scheme",
+			header:  `realm="https://auth.example.com/token"`,
+			wantErr: true,
+		},
+		{
+			name:    "unterminated quoted string",
+			header:  `Bearer realm="https://auth.example.com/token`,
+			wantErr: true,
+		},
+		{
+			name:    "missing token",
+			header:  `Bearer realm="x", =value`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseAuthChallengeHeader(tc.header)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseAuthChallengeHeader(%q) error = %v, wantErr %v", tc.header, err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseAuthChallengeHeader(%q) = %#v, want %#v", tc.header, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSelectAuthChallenge(t *testing.T) {
+	challenges, err := parseAuthChallenges([]string{
+		`Basic realm="registry"`,
+		`Bearer realm="https://auth.example.com/token",service="registry.example.com"`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := selectAuthChallenge(challenges)
+	if !c.IsBearer() || c.Service != "registry.example.com" {
+		t.Errorf("selectAuthChallenge() = %#v, want the bearer challenge", c)
+	}
+	if c := selectAuthChallenge(challenges[:1]); c == nil || c.Scheme != "basic" {
+		t.Errorf("selectAuthChallenge() = %#v, want the basic challenge", c)
+	}
+	if c := selectAuthChallenge(nil); c != nil {
+		t.Errorf("selectAuthChallenge(nil) = %#v, want nil", c)
+	}
+}
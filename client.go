@@ -26,6 +26,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/square/go-jose/v3/jwt"
@@ -33,7 +34,13 @@ import (
 
 // RegistryClient declares Docker Registry contract.
 type RegistryClient interface {
-	Token(ctx context.Context, endpoint, clientID, username, password, service, scope string) (*RegistryToken, error)
+	Challenge(ctx context.Context, registryURL string) (*AuthChallenge, error)
+	Token(ctx context.Context, tr *TokenRequest) (*RegistryToken, error)
+	Catalog(ctx context.Context, registryURL, authorization string) ([]string, error)
+	Tags(ctx context.Context, registryURL, authorization, repository string) ([]string, error)
+	ProbeRepository(ctx context.Context, registryURL, authorization, repository string) error
+	ProbeRateLimit(ctx context.Context, registryURL, authorization string) (*RateLimitStatus, error)
+	RateLimit(registryURL string) *RateLimitStatus
 }
 
 // -----------------------------------------------------------------------------
@@ -41,45 +48,108 @@ type RegistryClient interface {
 // RegistryToken represents a registry token information holder.
 type RegistryToken struct {
 	RegistryURL   string
+	Realm         string
 	Service       string
 	RequestScopes []string
 	TokenScopes   []string
 	Token         string
 	AccessToken   string
+	RefreshToken  string
+	IssuedAt      time.Time
 	ExpiresAt     time.Time
+	Claims        TokenClaims
+
+	// shared is set when the token was also handed to concurrent requests,
+	// its lease must not revoke it.
+	shared bool
 }
 
 // AsMap returns registry token as map.
 func (rt *RegistryToken) AsMap() map[string]interface{} {
 	return map[string]interface{}{
 		"registry_url":   rt.RegistryURL,
+		"realm":          rt.Realm,
 		"service":        rt.Service,
 		"request_scopes": rt.RequestScopes,
 		"token_scopes":   rt.TokenScopes,
 		"token":          rt.Token,
 		"access_token":   rt.AccessToken,
+		"refresh_token":  rt.RefreshToken,
+		"issued_at":      rt.IssuedAt.UTC(),
 		"expires_at":     rt.ExpiresAt.UTC(),
+		"claims":         rt.Claims.AsMap(),
+	}
+}
+
+// TokenClaims represents the registered claims of a registry token.
+type TokenClaims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ID        string
+	NotBefore time.Time
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// AsMap returns token claims as map, unset times are omitted.
+func (tc *TokenClaims) AsMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"iss": tc.Issuer,
+		"sub": tc.Subject,
+		"aud": tc.Audience,
+		"jti": tc.ID,
+	}
+	if !tc.NotBefore.IsZero() {
+		m["nbf"] = tc.NotBefore.UTC()
+	}
+	if !tc.IssuedAt.IsZero() {
+		m["iat"] = tc.IssuedAt.UTC()
 	}
+	if !tc.ExpiresAt.IsZero() {
+		m["exp"] = tc.ExpiresAt.UTC()
+	}
+	return m
 }
 
 // -----------------------------------------------------------------------------
 
 type jwtClaims struct {
-	Audience  string      `json:"aud"`
-	Issuer    string      `json:"iss"`
-	ExpiresAt uint64      `json:"exp"`
-	NotBefore uint64      `json:"nbf"`
-	IssuedAt  uint64      `json:"iat"`
-	Access    []jwtAccess `json:"access"`
+	jwt.Claims
+	Access []jwtAccess `json:"access"`
+}
+
+// TokenClaims returns the registered claims.
+func (jc *jwtClaims) TokenClaims() TokenClaims {
+	tc := TokenClaims{
+		Issuer:   jc.Issuer,
+		Subject:  jc.Subject,
+		Audience: []string(jc.Audience),
+		ID:       jc.ID,
+	}
+	if jc.NotBefore != nil {
+		tc.NotBefore = jc.NotBefore.Time()
+	}
+	if jc.IssuedAt != nil {
+		tc.IssuedAt = jc.IssuedAt.Time()
+	}
+	if jc.Expiry != nil {
+		tc.ExpiresAt = jc.Expiry.Time()
+	}
+	return tc
 }
 
 type jwtAccess struct {
 	Type    string   `json:"type"`
+	Class   string   `json:"class,omitempty"`
 	Name    string   `json:"name"`
 	Actions []string `json:"actions"`
 }
 
 func (ja *jwtAccess) String() string {
+	if ja.Class != "" {
+		return fmt.Sprintf("%s(%s):%s:%s", ja.Type, ja.Class, ja.Name, strings.Join(ja.Actions, ","))
+	}
 	return fmt.Sprintf("%s:%s:%s", ja.Type, ja.Name, strings.Join(ja.Actions, ","))
 }
 
@@ -87,101 +157,239 @@ func (ja *jwtAccess) String() string {
 
 // tokenResponse represents docker registry token response.
 type tokenResponse struct {
-	Token       string `json:"token"`
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int    `json:"expires_in"`
-	IssuedAt    string `json:"issued_at"`
-	JTI         string `json:"jti"`
-	Subject     string `json:"sub"`
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	ExpiresIn    int    `json:"expires_in"`
+	IssuedAt     string `json:"issued_at"`
+	JTI          string `json:"jti"`
+	Subject      string `json:"sub"`
+}
+
+// validity returns the token issuance and expiration times. The JWT claims
+// are authoritative, response fields are used as fallback with the spec
+// default lifetime when expires_in is missing.
+func (tr *tokenResponse) validity(claims *jwtClaims, now time.Time) (time.Time, time.Time) {
+	issuedAt := now
+	switch {
+	case claims.IssuedAt != nil:
+		issuedAt = claims.IssuedAt.Time()
+	case tr.IssuedAt != "":
+		if t, err := time.Parse(time.RFC3339, tr.IssuedAt); err == nil {
+			issuedAt = t
+		}
+	}
+
+	if claims.Expiry != nil {
+		return issuedAt, claims.Expiry.Time()
+	}
+
+	expiresIn := time.Duration(tr.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = defaultTokenExpiresIn
+	}
+
+	return issuedAt, issuedAt.Add(expiresIn)
 }
 
 // -----------------------------------------------------------------------------
 
+const (
+	// challengeCacheTTL defines how long a discovered challenge is reused.
+	challengeCacheTTL = 15 * time.Minute
+	// listPageSize is the page size requested to list endpoints.
+	listPageSize = 100
+	// listMaxPages limits the pages followed by a single listing.
+	listMaxPages = 1000
+	// defaultTokenExpiresIn is the token lifetime assumed by the token
+	// specification when the response has no expires_in.
+	defaultTokenExpiresIn = 60 * time.Second
+)
+
+type cachedChallenge struct {
+	challenge *AuthChallenge
+	expiresAt time.Time
+}
+
 type registryClient struct {
 	httpClient *http.Client
+
+	challengeLock  sync.RWMutex
+	challengeCache map[string]cachedChallenge
+
+	// rateLimits holds the last RateLimit headers returned by each registry.
+	rateLimitLock sync.RWMutex
+	rateLimits    map[string]*RateLimitStatus
 }
 
-// NewRegistryClient returns a default docker registry client implementation.
-func NewRegistryClient() RegistryClient {
+// NewRegistryClient returns a default docker registry client implementation
+// using the given HTTP client.
+func NewRegistryClient(httpClient *http.Client) RegistryClient {
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Timeout: defaultHTTPTimeout,
+		}
+	}
+
 	return &registryClient{
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+		httpClient:     httpClient,
+		challengeCache: map[string]cachedChallenge{},
+		rateLimits:     map[string]*RateLimitStatus{},
 	}
 }
 
-// Token call external authentication endpoint to rtrieve a session token.
-func (rc *registryClient) Token(ctx context.Context, endpoint, clientID, username, password, service, scope string) (*RegistryToken, error) {
+// Challenge pings the registry API base endpoint to discover the
+// authentication challenge. Successful discoveries are cached.
+func (rc *registryClient) Challenge(ctx context.Context, registryURL string) (*AuthChallenge, error) {
 	// Check arguments
-	if endpoint == "" {
-		return nil, errors.New("unable to query registry without endpoint url defined")
+	if registryURL == "" {
+		return nil, errors.New("unable to query registry without registry url defined")
+	}
+
+	// Check cache
+	if challenge := rc.knownChallenge(registryURL); challenge != nil {
+		return challenge, nil
 	}
 
 	// Parse endpoint
-	endpointURL, err := url.Parse(fmt.Sprintf("%s/token", endpoint))
+	pingURL, err := url.Parse(fmt.Sprintf("%s/v2/", strings.TrimSuffix(registryURL, "/")))
 	if err != nil {
-		return nil, fmt.Errorf("endpoint_url is not a valid URL: %v", err)
+		return nil, fmt.Errorf("registry_url is not a valid URL: %v", err)
 	}
 
 	// Prepare context
 	rctx, rcancel := context.WithTimeout(ctx, 30*time.Second)
 	defer rcancel()
 
-	// Prepare params
-	params := url.Values{}
+	// Prepare request
+	req, err := http.NewRequestWithContext(rctx, http.MethodGet, pingURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare docker registry request: %v", err)
+	}
 
-	if clientID != "" {
-		params.Add("client_id", clientID)
+	// Do the request
+	resp, err := rc.do(req, endpointChallenge)
+	if err != nil {
+		return nil, fmt.Errorf("error pinging registry %q: %w", registryURL, err)
 	}
-	if service != "" {
-		params.Add("service", service)
+	defer resp.Body.Close()
+
+	var challenge *AuthChallenge
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// No authentication required
+		challenge = &AuthChallenge{}
+	case http.StatusUnauthorized:
+		challenges, err := parseAuthChallenges(resp.Header.Values("WWW-Authenticate"))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing registry %q challenge: %v", registryURL, err)
+		}
+		challenge = selectAuthChallenge(challenges)
+		if challenge == nil {
+			return nil, fmt.Errorf("registry %q did not return an authentication challenge", registryURL)
+		}
+	default:
+		return nil, fmt.Errorf("error pinging registry %q: %w", registryURL, newRegistryError(resp))
 	}
-	if scope != "" {
-		params.Add("scope", scope)
+
+	// Update cache
+	rc.challengeLock.Lock()
+	rc.challengeCache[registryURL] = cachedChallenge{
+		challenge: challenge,
+		expiresAt: time.Now().Add(challengeCacheTTL),
 	}
-	endpointURL.RawQuery = params.Encode()
+	rc.challengeLock.Unlock()
+
+	return challenge, nil
+}
+
+// knownChallenge returns the cached challenge of the registry, nil if none
+// or expired.
+func (rc *registryClient) knownChallenge(registryURL string) *AuthChallenge {
+	rc.challengeLock.RLock()
+	defer rc.challengeLock.RUnlock()
+
+	cached, ok := rc.challengeCache[registryURL]
+	if !ok || !time.Now().Before(cached.expiresAt) {
+		return nil
+	}
+	return cached.challenge
+}
+
+// Token call external authentication endpoint to rtrieve a session token.
+func (rc *registryClient) Token(ctx context.Context, tr *TokenRequest) (*RegistryToken, error) {
+	// Check arguments
+	if tr == nil {
+		return nil, errors.New("unable to query registry without token request")
+	}
+	if tr.Realm == "" {
+		return nil, errors.New("unable to query registry without token realm defined")
+	}
+
+	// Parse endpoint
+	endpointURL, err := url.Parse(tr.Realm)
+	if err != nil {
+		return nil, fmt.Errorf("token realm is not a valid URL: %v", err)
+	}
+
+	// Prepare context
+	rctx, rcancel := context.WithTimeout(ctx, 30*time.Second)
+	defer rcancel()
 
 	// Prepare request
-	req, err := http.NewRequestWithContext(rctx, http.MethodGet, endpointURL.String(), nil)
+	var req *http.Request
+	switch tr.Flow {
+	case tokenFlowOAuth2:
+		req, err = tr.oauth2Request(rctx, endpointURL)
+	case tokenFlowBasic, "":
+		req, err = tr.basicRequest(rctx, endpointURL)
+	default:
+		err = fmt.Errorf("unsupported token flow %q", tr.Flow)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("unable to prepare docker registry request: %v", err)
 	}
 
-	// Assign basic authentication if credentials provided
-	if username != "" && password != "" {
-		req.SetBasicAuth(username, password)
-	}
+	scope := tr.Scope()
 
 	// Do the request
-	resp, err := rc.httpClient.Do(req)
+	resp, err := rc.do(req, endpointToken)
 	if err != nil {
-		return nil, fmt.Errorf("error getting auth token for service='%s' scope='%s': %v", service, scope, err)
+		return nil, fmt.Errorf("error getting auth token for service='%s' scope='%s': %w", tr.Service, scope, err)
 	}
 	defer resp.Body.Close()
 
-	// Drain body
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("error getting auth token for %q: %s", scope, resp.Status)
+	// Decode registry error
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting auth token for %q: %w", scope, newRegistryError(resp))
 	}
 
 	// Extract token response
 	var data tokenResponse
 	if err := json.NewDecoder(io.LimitReader(resp.Body, 5<<20)).Decode(&data); err != nil {
-		return nil, fmt.Errorf("error parsing token for %q: %s", scope, resp.Status)
+		return nil, fmt.Errorf("error parsing token for %q: %v", scope, err)
 	}
 
-	// Decode JWT to extract effective accesses
-	token, err := jwt.ParseSigned(data.Token)
-	if err != nil {
-		return nil, fmt.Errorf("error validating token for %q: %s", scope, resp.Status)
+	// OAuth2 responses only contain the access_token field
+	if data.Token == "" {
+		data.Token = data.AccessToken
+	}
+	if data.AccessToken == "" {
+		data.AccessToken = data.Token
 	}
 
-	// Can't check signature complete certificate chain is not provided
+	// Verify JWT and extract effective accesses
+	now := time.Now()
+	claims, err := tr.verifier.verify(data.Token, tr.Service, now, tr.ClockSkew)
+	if err != nil {
+		return nil, fmt.Errorf("error validating token for %q: %v", scope, err)
+	}
 
-	// Extract scope form token
-	var claims jwtClaims
-	if err := token.UnsafeClaimsWithoutVerification(&claims); err != nil {
-		return nil, fmt.Errorf("unable to extract token claims: %v", err)
+	// Compute token validity
+	issuedAt, expiresAt := data.validity(claims, now)
+	if expiresAt.Before(now.Add(-tr.ClockSkew)) {
+		return nil, fmt.Errorf("error validating token for %q: token expired at %s", scope, expiresAt.UTC())
 	}
 
 	tokenScopes := []string{}
@@ -191,12 +399,213 @@ func (rc *registryClient) Token(ctx context.Context, endpoint, clientID, usernam
 
 	// No error
 	return &RegistryToken{
-		RegistryURL:   endpoint,
-		Service:       service,
-		RequestScopes: strings.Split(scope, " "),
+		Realm:         tr.Realm,
+		Service:       tr.Service,
+		RequestScopes: tr.Scopes,
 		TokenScopes:   tokenScopes,
 		Token:         data.Token,
 		AccessToken:   data.AccessToken,
-		ExpiresAt:     time.Now().Add(time.Duration(data.ExpiresIn) * time.Second),
+		RefreshToken:  data.RefreshToken,
+		IssuedAt:      issuedAt,
+		ExpiresAt:     expiresAt,
+		Claims:        claims.TokenClaims(),
 	}, nil
 }
+
+// Catalog lists the registry repositories, following pagination links.
+func (rc *registryClient) Catalog(ctx context.Context, registryURL, authorization string) ([]string, error) {
+	return rc.list(ctx, fmt.Sprintf("%s/v2/_catalog", strings.TrimSuffix(registryURL, "/")), authorization, func(lr *listResponse) []string {
+		return lr.Repositories
+	})
+}
+
+// Tags lists the repository tags, following pagination links.
+func (rc *registryClient) Tags(ctx context.Context, registryURL, authorization, repository string) ([]string, error) {
+	return rc.list(ctx, fmt.Sprintf("%s/v2/%s/tags/list", strings.TrimSuffix(registryURL, "/"), repository), authorization, func(lr *listResponse) []string {
+		return lr.Tags
+	})
+}
+
+// ProbeRepository checks the repository is readable by requesting the first
+// page of its tags. The registry error is returned when it is not.
+func (rc *registryClient) ProbeRepository(ctx context.Context, registryURL, authorization, repository string) error {
+	pageURL, err := url.Parse(fmt.Sprintf("%s/v2/%s/tags/list?n=1", strings.TrimSuffix(registryURL, "/"), repository))
+	if err != nil {
+		return fmt.Errorf("registry probe endpoint is not a valid URL: %v", err)
+	}
+
+	var lr listResponse
+	_, err = rc.getPage(ctx, pageURL, authorization, &lr)
+	return err
+}
+
+// ProbeRateLimit sends a manifest HEAD request for the Docker Hub rate limit
+// test repository, and returns the advertised quota. HEAD requests don't
+// consume the quota.
+func (rc *registryClient) ProbeRateLimit(ctx context.Context, registryURL, authorization string) (*RateLimitStatus, error) {
+	probeURL := fmt.Sprintf("%s/v2/%s/manifests/latest", strings.TrimSuffix(registryURL, "/"), rateLimitProbeRepository)
+
+	// Prepare context
+	rctx, rcancel := context.WithTimeout(ctx, 30*time.Second)
+	defer rcancel()
+
+	// Prepare request
+	req, err := http.NewRequestWithContext(rctx, http.MethodHead, probeURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare docker registry request: %v", err)
+	}
+	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	// Do the request
+	resp, err := rc.do(req, endpointRateLimit)
+	if err != nil {
+		return nil, fmt.Errorf("error probing registry rate limit: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error probing registry rate limit: %w", newRegistryError(resp))
+	}
+
+	return parseRateLimitHeaders(resp.Header), nil
+}
+
+// RateLimit returns the last quota advertised by the registry, nil if none
+// was observed.
+func (rc *registryClient) RateLimit(registryURL string) *RateLimitStatus {
+	rc.rateLimitLock.RLock()
+	defer rc.rateLimitLock.RUnlock()
+
+	u, err := url.Parse(registryURL)
+	if err != nil {
+		return nil
+	}
+	return rc.rateLimits[rateLimitKey(u)]
+}
+
+// do sends the request, records the RateLimit headers of the response and
+// emits the request metrics under the given endpoint kind.
+func (rc *registryClient) do(req *http.Request, endpoint string) (*http.Response, error) {
+	start := time.Now()
+	resp, err := rc.httpClient.Do(req)
+	emitUpstream(endpoint, start, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if status := parseRateLimitHeaders(resp.Header); status != nil {
+		rc.rateLimitLock.Lock()
+		rc.rateLimits[rateLimitKey(req.URL)] = status
+		rc.rateLimitLock.Unlock()
+	}
+
+	return resp, nil
+}
+
+// listResponse represents catalog and tags list responses.
+type listResponse struct {
+	Repositories []string `json:"repositories"`
+	Name         string   `json:"name"`
+	Tags         []string `json:"tags"`
+}
+
+// list calls a paginated list endpoint and accumulates the items returned
+// by extract.
+func (rc *registryClient) list(ctx context.Context, endpoint, authorization string, extract func(*listResponse) []string) ([]string, error) {
+	// Parse endpoint
+	pageURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("registry list endpoint is not a valid URL: %v", err)
+	}
+	params := pageURL.Query()
+	params.Set("n", fmt.Sprintf("%d", listPageSize))
+	pageURL.RawQuery = params.Encode()
+
+	items := []string{}
+	for page := 0; pageURL != nil; page++ {
+		if page >= listMaxPages {
+			return nil, fmt.Errorf("registry listing of %q exceeds %d pages", endpoint, listMaxPages)
+		}
+
+		var lr listResponse
+		next, err := rc.getPage(ctx, pageURL, authorization, &lr)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, extract(&lr)...)
+		pageURL = next
+	}
+
+	return items, nil
+}
+
+// getPage fetches and decodes a single list page, and returns the next page
+// URL from the Link header.
+func (rc *registryClient) getPage(ctx context.Context, pageURL *url.URL, authorization string, out interface{}) (*url.URL, error) {
+	// Prepare context
+	rctx, rcancel := context.WithTimeout(ctx, 30*time.Second)
+	defer rcancel()
+
+	// Prepare request
+	req, err := http.NewRequestWithContext(rctx, http.MethodGet, pageURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare docker registry request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	// Do the request
+	resp, err := rc.do(req, endpointList)
+	if err != nil {
+		return nil, fmt.Errorf("error listing %q: %w", pageURL.Path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error listing %q: %w", pageURL.Path, newRegistryError(resp))
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 20<<20)).Decode(out); err != nil {
+		return nil, fmt.Errorf("error parsing %q listing: %v", pageURL.Path, err)
+	}
+
+	return nextLink(pageURL, resp.Header.Values("Link")), nil
+}
+
+// nextLink extracts the rel="next" target from Link headers, resolved against
+// the current page URL.
+func nextLink(current *url.URL, links []string) *url.URL {
+	for _, header := range links {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+
+			isNext := false
+			for _, p := range parts[1:] {
+				p = strings.ReplaceAll(strings.TrimSpace(p), " ", "")
+				if p == `rel="next"` || p == "rel=next" {
+					isNext = true
+				}
+			}
+			if !isNext {
+				continue
+			}
+
+			u, err := current.Parse(strings.Trim(target, "<>"))
+			if err != nil {
+				return nil
+			}
+			return u
+		}
+	}
+
+	return nil
+}
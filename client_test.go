@@ -0,0 +1,90 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNextLink(t *testing.T) {
+	current, err := url.Parse("https://registry.example.com/v2/_catalog?n=100")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		name  string
+		links []string
+		want  string
+	}{
+		{
+			name:  "docker distribution",
+			links: []string{`</v2/_catalog?last=library%2Fubuntu&n=100>; rel="next"`},
+			want:  "https://registry.example.com/v2/_catalog?last=library%2Fubuntu&n=100",
+		},
+		{
+			name:  "ghcr absolute",
+			links: []string{`<https://ghcr.io/v2/user/image/tags/list?last=v1.2.3&n=0>; rel="next"`},
+			want:  "https://ghcr.io/v2/user/image/tags/list?last=v1.2.3&n=0",
+		},
+		{
+			name:  "harbor with several relations",
+			links: []string{`</v2/_catalog?last=project%2Fapp&n=100>; rel="prev", </v2/_catalog?last=project%2Fzeta&n=100>; rel="next"`},
+			want:  "https://registry.example.com/v2/_catalog?last=project%2Fzeta&n=100",
+		},
+		{
+			name:  "unquoted relation and spaces",
+			links: []string{`</v2/_catalog?last=b> ; rel = next`},
+			want:  "https://registry.example.com/v2/_catalog?last=b",
+		},
+		{
+			name:  "several headers",
+			links: []string{`</v2/_catalog?last=a>; rel="prev"`, `</v2/_catalog?last=c>; rel="next"`},
+			want:  "https://registry.example.com/v2/_catalog?last=c",
+		},
+		{
+			name: "no header",
+		},
+		{
+			name:  "no next relation",
+			links: []string{`</v2/_catalog?last=a>; rel="prev"`},
+		},
+		{
+			name:  "missing angle brackets",
+			links: []string{`/v2/_catalog?last=a; rel="next"`},
+		},
+		{
+			name:  "invalid target",
+			links: []string{`<http://[::1>; rel="next"`},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got := nextLink(current, tc.links)
+			switch {
+			case tc.want == "" && got != nil:
+				t.Errorf("nextLink(%q) = %q, want nil", tc.links, got)
+			case tc.want != "" && (got == nil || got.String() != tc.want):
+				t.Errorf("nextLink(%q) = %v, want %q", tc.links, got, tc.want)
+			}
+		})
+	}
+}
@@ -18,27 +18,66 @@
 package dockerregistry
 
 import (
+	"fmt"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 )
 
 const (
-	defaultEndpoint = "https://auth.docker.io"
+	defaultRegistryURL = "https://registry-1.docker.io"
+	defaultClockSkew   = 30 * time.Second
+
+	defaultCatalogRefreshInterval = 5 * time.Minute
+	defaultMaxScopeExpansion      = 100
+	defaultHealthCheckInterval    = time.Hour
+	defaultUpstreamBurst          = 10
 )
 
 // Config is the stored configuration.
 type Config struct {
-	EndpointURL string `json:"endpoint_url"`
-	ClientID    string `json:"client_id"`
-	Username    string `json:"username"`
-	Password    string `json:"password"`
+	RegistryURL  string `json:"registry_url"`
+	EndpointURL  string `json:"endpoint_url"`
+	TokenFlow    string `json:"token_flow"`
+	ClientID     string `json:"client_id"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	RefreshToken string `json:"refresh_token"`
+
+	TrustedCertificates string        `json:"trusted_certificates"`
+	JWKS                string        `json:"jwks"`
+	TokenIssuer         string        `json:"token_issuer"`
+	ClockSkew           time.Duration `json:"clock_skew"`
+
+	CatalogRefreshInterval time.Duration `json:"catalog_refresh_interval"`
+	MaxScopeExpansion      int           `json:"max_scope_expansion"`
+	HealthCheckInterval    time.Duration `json:"health_check_interval"`
+
+	// UpstreamRateLimit is the mount budget of upstream requests per minute.
+	UpstreamRateLimit int `json:"upstream_rate_limit"`
+	UpstreamBurst     int `json:"upstream_burst"`
+
+	TransportConfig
+	RetryPolicy
+	RotationConfig
 }
 
 // DefaultConfig returns a config with the default values.
 func DefaultConfig() *Config {
 	return &Config{
-		EndpointURL: defaultEndpoint,
+		RegistryURL: defaultRegistryURL,
+		TokenFlow:   tokenFlowBasic,
+		ClockSkew:   defaultClockSkew,
+
+		CatalogRefreshInterval: defaultCatalogRefreshInterval,
+		MaxScopeExpansion:      defaultMaxScopeExpansion,
+		HealthCheckInterval:    defaultHealthCheckInterval,
+		TransportConfig: TransportConfig{
+			TLSMinVersion: defaultTLSMinVersion,
+		},
+		RetryPolicy: DefaultRetryPolicy(),
 	}
 }
 
@@ -50,14 +89,38 @@ func (c *Config) Update(d *framework.FieldData) (bool, error) {
 
 	changed := false
 
+	if v, ok := d.GetOk("registry_url"); ok {
+		nv, err := normalizeRegistryURL(v.(string))
+		if err != nil {
+			return false, err
+		}
+		if nv != c.RegistryURL {
+			c.RegistryURL = nv
+			changed = true
+		}
+	}
+
 	if v, ok := d.GetOk("endpoint_url"); ok {
-		nv := strings.TrimSpace(v.(string))
+		nv := strings.TrimSuffix(strings.TrimSpace(v.(string)), "/")
 		if nv != c.EndpointURL {
 			c.EndpointURL = nv
 			changed = true
 		}
 	}
 
+	if v, ok := d.GetOk("token_flow"); ok {
+		nv := strings.TrimSpace(v.(string))
+		switch nv {
+		case tokenFlowBasic, tokenFlowOAuth2:
+		default:
+			return false, fmt.Errorf("token_flow %q is not supported, expected %q or %q", nv, tokenFlowBasic, tokenFlowOAuth2)
+		}
+		if nv != c.TokenFlow {
+			c.TokenFlow = nv
+			changed = true
+		}
+	}
+
 	if v, ok := d.GetOk("client_id"); ok {
 		nv := strings.TrimSpace(v.(string))
 		if nv != c.ClientID {
@@ -82,15 +145,292 @@ func (c *Config) Update(d *framework.FieldData) (bool, error) {
 		}
 	}
 
+	if v, ok := d.GetOk("refresh_token"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != c.RefreshToken {
+			c.RefreshToken = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("trusted_certificates"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != c.TrustedCertificates {
+			c.TrustedCertificates = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("jwks"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != c.JWKS {
+			c.JWKS = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("token_issuer"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != c.TokenIssuer {
+			c.TokenIssuer = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("clock_skew"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv < 0 {
+			return false, fmt.Errorf("clock_skew must be positive")
+		}
+		if nv != c.ClockSkew {
+			c.ClockSkew = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("catalog_refresh_interval"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv < 0 {
+			return false, fmt.Errorf("catalog_refresh_interval must be positive")
+		}
+		if nv != c.CatalogRefreshInterval {
+			c.CatalogRefreshInterval = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("max_scope_expansion"); ok {
+		nv := v.(int)
+		if nv < 1 {
+			return false, fmt.Errorf("max_scope_expansion must be greater than 0")
+		}
+		if nv != c.MaxScopeExpansion {
+			c.MaxScopeExpansion = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("health_check_interval"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv < 0 {
+			return false, fmt.Errorf("health_check_interval must be positive")
+		}
+		if nv != c.HealthCheckInterval {
+			c.HealthCheckInterval = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("upstream_rate_limit"); ok {
+		nv := v.(int)
+		if nv < 0 {
+			return false, fmt.Errorf("upstream_rate_limit must be positive")
+		}
+		if nv != c.UpstreamRateLimit {
+			c.UpstreamRateLimit = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("upstream_burst"); ok {
+		nv := v.(int)
+		if nv < 0 {
+			return false, fmt.Errorf("upstream_burst must be positive")
+		}
+		if nv != c.UpstreamBurst {
+			c.UpstreamBurst = nv
+			changed = true
+		}
+	}
+
+	// Validate trusted material
+	if _, err := c.TokenVerifier(); err != nil {
+		return false, err
+	}
+
+	// Update transport settings
+	transportChanged, err := c.TransportConfig.Update(d)
+	if err != nil {
+		return false, err
+	}
+	changed = changed || transportChanged
+
+	// Update retry policy
+	retryChanged, err := c.RetryPolicy.Update(d)
+	if err != nil {
+		return false, err
+	}
+	changed = changed || retryChanged
+
+	// Update rotation settings
+	rotationChanged, err := c.RotationConfig.Update(d)
+	if err != nil {
+		return false, err
+	}
+	changed = changed || rotationChanged
+
+	if c.TokenFlow == tokenFlowBasic && c.RefreshToken != "" && c.Password == "" {
+		return false, fmt.Errorf("refresh_token authentication requires the %q token_flow", tokenFlowOAuth2)
+	}
+
 	return changed, nil
 }
 
+// clone returns a deep copy of the configuration.
+func (c *Config) clone() *Config {
+	rc := *c
+	if c.NoProxy != nil {
+		rc.NoProxy = append([]string{}, c.NoProxy...)
+	}
+	return &rc
+}
+
 // AsMap returns configuration object as map.
 func (c *Config) AsMap() map[string]interface{} {
-	return map[string]interface{}{
-		"endpoint_url": c.EndpointURL,
-		"client_id":    c.ClientID,
-		"username":     c.Username,
-		"password":     c.Password,
+	m := map[string]interface{}{
+		"registry_url":             c.RegistryURL,
+		"endpoint_url":             c.EndpointURL,
+		"token_flow":               c.TokenFlow,
+		"client_id":                c.ClientID,
+		"username":                 c.Username,
+		"password":                 c.Password,
+		"refresh_token_set":        c.RefreshToken != "",
+		"trusted_certificates":     c.TrustedCertificates,
+		"jwks":                     c.JWKS,
+		"token_issuer":             c.TokenIssuer,
+		"clock_skew":               int64(c.ClockSkew.Seconds()),
+		"catalog_refresh_interval": int64(c.CatalogRefreshInterval.Seconds()),
+		"max_scope_expansion":      c.MaxScopeExpansion,
+		"health_check_interval":    int64(c.HealthCheckInterval.Seconds()),
+		"upstream_rate_limit":      c.UpstreamRateLimit,
+		"upstream_burst":           c.upstreamBurst(),
+		"ca_certificate":           c.CACertificate,
+		"client_certificate":       c.ClientCertificate,
+		"tls_min_version":          c.TLSMinVersion,
+		"proxy_url":                c.ProxyURL,
+		"no_proxy":                 c.NoProxy,
+		"insecure_skip_verify":     c.InsecureSkipVerify,
+	}
+	for k, v := range c.RetryPolicy.AsMap() {
+		m[k] = v
+	}
+	for k, v := range c.RotationConfig.AsMap() {
+		m[k] = v
+	}
+	return m
+}
+
+// upstreamBurst returns the number of upstream requests allowed at once.
+func (c *Config) upstreamBurst() int {
+	if c.UpstreamBurst == 0 {
+		return defaultUpstreamBurst
+	}
+	return c.UpstreamBurst
+}
+
+// TokenVerifier returns the verifier built from the configured trusted
+// material, nil if none is configured.
+func (c *Config) TokenVerifier() (*tokenVerifier, error) {
+	return newTokenVerifier(c.TrustedCertificates, c.JWKS, c.TokenIssuer)
+}
+
+// TokenRequest returns a token request prepared with the engine credentials.
+func (c *Config) TokenRequest(realm, service string, scopes []string) (*TokenRequest, error) {
+	verifier, err := c.TokenVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenRequest{
+		Flow:         c.TokenFlow,
+		Realm:        realm,
+		ClientID:     c.ClientID,
+		Username:     c.Username,
+		Password:     c.Password,
+		RefreshToken: c.RefreshToken,
+		Service:      service,
+		Scopes:       scopes,
+		ClockSkew:    c.ClockSkew,
+		verifier:     verifier,
+	}, nil
+}
+
+// ForRegistry returns the configuration targeting a registry of a
+// multi-registry role, nil targets the engine registry. The engine credentials
+// and trusted material are kept only for the engine registry when the entry
+// declares none, other registries use the entry ones or stay anonymous. The
+// token endpoint of another registry is discovered from that registry.
+func (c *Config) ForRegistry(rr *RoleRegistry) *Config {
+	if rr == nil {
+		return c
 	}
+	foreign := rr.Endpoint != "" && rr.Endpoint != c.RegistryURL
+	if !foreign && !rr.hasCredentials() && !rr.hasTrustedMaterial() {
+		return c
+	}
+
+	rc := *c
+	if foreign {
+		rc.RegistryURL = rr.Endpoint
+		rc.EndpointURL = ""
+	}
+	rc.RotationConfig = RotationConfig{}
+
+	// Registry identity
+	if foreign || rr.hasCredentials() {
+		// The engine registry flow is kept unless overridden
+		switch {
+		case rr.TokenFlow != "":
+			rc.TokenFlow = rr.TokenFlow
+		case foreign:
+			rc.TokenFlow = tokenFlowBasic
+		}
+		rc.ClientID = rr.ClientID
+		rc.Username = rr.Username
+		rc.Password = rr.Password
+		rc.RefreshToken = rr.RefreshToken
+	}
+
+	// Token verification
+	if foreign || rr.hasTrustedMaterial() {
+		rc.TrustedCertificates = rr.TrustedCertificates
+		rc.JWKS = rr.JWKS
+		rc.TokenIssuer = rr.TokenIssuer
+	}
+
+	return &rc
+}
+
+// TokenRealm returns the explicitly configured token endpoint, or an empty
+// string when the realm must be discovered from the registry challenge.
+func (c *Config) TokenRealm() string {
+	if c.EndpointURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/token", c.EndpointURL)
+}
+
+// normalizeRegistryURL accepts a registry host or URL and returns the registry
+// base URL, defaulting to the https scheme.
+func normalizeRegistryURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("registry_url is not a valid URL: %v", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", fmt.Errorf("registry_url has an unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("registry_url %q has no host", raw)
+	}
+
+	return strings.TrimSuffix(fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, u.Path), "/"), nil
 }
@@ -0,0 +1,107 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import "testing"
+
+func TestConfigForRegistry(t *testing.T) {
+	engine := DefaultConfig()
+	engine.RegistryURL = "https://registry.example.com"
+	engine.EndpointURL = "https://auth.example.com"
+	engine.TokenFlow = tokenFlowOAuth2
+	engine.Username = "mount"
+	engine.Password = "mount-secret"
+	engine.JWKS = `{"keys":[]}`
+	engine.TokenIssuer = "mount-issuer"
+
+	testCases := []struct {
+		name         string
+		registry     *RoleRegistry
+		wantURL      string
+		wantFlow     string
+		wantUsername string
+		wantPassword string
+		wantIssuer   string
+	}{
+		{
+			name:         "engine registry",
+			wantURL:      "https://registry.example.com",
+			wantFlow:     tokenFlowOAuth2,
+			wantUsername: "mount",
+			wantPassword: "mount-secret",
+			wantIssuer:   "mount-issuer",
+		},
+		{
+			name:         "empty endpoint",
+			registry:     &RoleRegistry{},
+			wantURL:      "https://registry.example.com",
+			wantFlow:     tokenFlowOAuth2,
+			wantUsername: "mount",
+			wantPassword: "mount-secret",
+			wantIssuer:   "mount-issuer",
+		},
+		{
+			name:         "engine registry with own credentials",
+			registry:     &RoleRegistry{Endpoint: "https://registry.example.com", Username: "robot", Password: "robot-secret"},
+			wantURL:      "https://registry.example.com",
+			wantFlow:     tokenFlowOAuth2,
+			wantUsername: "robot",
+			wantPassword: "robot-secret",
+			wantIssuer:   "mount-issuer",
+		},
+		{
+			name:         "engine registry with own credentials and flow",
+			registry:     &RoleRegistry{Username: "robot", Password: "robot-secret", TokenFlow: tokenFlowBasic},
+			wantURL:      "https://registry.example.com",
+			wantFlow:     tokenFlowBasic,
+			wantUsername: "robot",
+			wantPassword: "robot-secret",
+			wantIssuer:   "mount-issuer",
+		},
+		{
+			name:     "foreign registry without credentials",
+			registry: &RoleRegistry{Endpoint: "https://ghcr.io"},
+			wantURL:  "https://ghcr.io",
+			wantFlow: tokenFlowBasic,
+		},
+		{
+			name:         "foreign registry with own credentials",
+			registry:     &RoleRegistry{Endpoint: "https://harbor.internal", Username: "robot", Password: "robot-secret", TokenIssuer: "harbor-token-issuer"},
+			wantURL:      "https://harbor.internal",
+			wantFlow:     tokenFlowBasic,
+			wantUsername: "robot",
+			wantPassword: "robot-secret",
+			wantIssuer:   "harbor-token-issuer",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got := engine.ForRegistry(tc.registry)
+			if got.RegistryURL != tc.wantURL || got.TokenFlow != tc.wantFlow || got.Username != tc.wantUsername || got.Password != tc.wantPassword || got.TokenIssuer != tc.wantIssuer {
+				t.Errorf("ForRegistry() = {%s %s %s %s %s}, want {%s %s %s %s %s}",
+					got.RegistryURL, got.TokenFlow, got.Username, got.Password, got.TokenIssuer,
+					tc.wantURL, tc.wantFlow, tc.wantUsername, tc.wantPassword, tc.wantIssuer)
+			}
+			if got.RegistryURL != engine.RegistryURL && (got.EndpointURL != "" || got.JWKS != "") {
+				t.Errorf("ForRegistry() kept the engine token endpoint or trusted material for %s", got.RegistryURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// RegistryErrorDetail represents an error entry of a registry error body.
+type RegistryErrorDetail struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+// RegistryError represents an error response returned by the registry or its
+// token service.
+type RegistryError struct {
+	StatusCode       int
+	Status           string
+	Errors           []RegistryErrorDetail
+	OAuthError       string
+	OAuthDescription string
+	RetryAfter       time.Duration
+}
+
+// registryErrorBody represents both registry and OAuth2 error bodies.
+type registryErrorBody struct {
+	Errors           []RegistryErrorDetail `json:"errors"`
+	Details          string                `json:"details"`
+	Error            string                `json:"error"`
+	ErrorDescription string                `json:"error_description"`
+}
+
+// newRegistryError builds a registry error from a non-successful response,
+// the response body is decoded when it matches a known error format.
+func newRegistryError(resp *http.Response) *RegistryError {
+	re := &RegistryError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	payload, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil || len(payload) == 0 {
+		return re
+	}
+
+	var body registryErrorBody
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return re
+	}
+
+	re.Errors = body.Errors
+	re.OAuthError = body.Error
+	re.OAuthDescription = body.ErrorDescription
+	if re.OAuthDescription == "" {
+		// Docker Hub token service uses the details field
+		re.OAuthDescription = body.Details
+	}
+
+	return re
+}
+
+// parseRetryAfter decodes a Retry-After header value, expressed in seconds or
+// as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// Message returns the error message reported by the registry.
+func (e *RegistryError) Message() string {
+	parts := []string{}
+	for _, d := range e.Errors {
+		switch {
+		case d.Code != "" && d.Message != "":
+			parts = append(parts, fmt.Sprintf("%s: %s", d.Code, d.Message))
+		case d.Message != "":
+			parts = append(parts, d.Message)
+		case d.Code != "":
+			parts = append(parts, d.Code)
+		}
+	}
+
+	switch {
+	case e.OAuthError != "" && e.OAuthDescription != "":
+		parts = append(parts, fmt.Sprintf("%s: %s", e.OAuthError, e.OAuthDescription))
+	case e.OAuthError != "":
+		parts = append(parts, e.OAuthError)
+	case e.OAuthDescription != "":
+		parts = append(parts, e.OAuthDescription)
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// Error implements the error interface.
+func (e *RegistryError) Error() string {
+	if msg := e.Message(); msg != "" {
+		return fmt.Sprintf("registry returned %s: %s", e.Status, msg)
+	}
+	return fmt.Sprintf("registry returned %s", e.Status)
+}
+
+// -----------------------------------------------------------------------------
+
+// codedRegistryError maps registry and transport errors to coded errors so
+// callers can distinguish bad credentials from upstream outages. Other errors
+// are returned unchanged.
+func codedRegistryError(err error) error {
+	if errors.Is(err, errUpstreamBudget) {
+		return logical.CodedError(http.StatusTooManyRequests, fmt.Sprintf("%s: %v, retry later", logical.ErrUpstreamRateLimited, errUpstreamBudget))
+	}
+
+	var re *RegistryError
+	if errors.As(err, &re) {
+		msg := re.Message()
+		if msg == "" {
+			msg = re.Status
+		}
+
+		switch {
+		case re.StatusCode == http.StatusUnauthorized, re.StatusCode == http.StatusForbidden:
+			return logical.CodedError(http.StatusForbidden, fmt.Sprintf("%s: registry denied the request: %s", logical.ErrPermissionDenied, msg))
+		case re.StatusCode == http.StatusTooManyRequests:
+			return logical.CodedError(http.StatusTooManyRequests, fmt.Sprintf("%s: %s", logical.ErrUpstreamRateLimited, msg))
+		case re.StatusCode >= 500:
+			return logical.CodedError(http.StatusBadGateway, fmt.Sprintf("upstream unavailable: %s", msg))
+		case re.StatusCode >= 400:
+			return logical.CodedError(http.StatusBadRequest, fmt.Sprintf("registry rejected the request: %s", msg))
+		}
+	}
+
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return logical.CodedError(http.StatusBadGateway, fmt.Sprintf("upstream unavailable: %v", ue))
+	}
+
+	return err
+}
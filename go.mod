@@ -3,10 +3,14 @@ module github.com/zntrio/vault-plugin-secrets-docker-registry
 go 1.14
 
 require (
+	github.com/armon/go-metrics v0.3.3
 	github.com/hashicorp/errwrap v1.0.0
+	github.com/hashicorp/go-cleanhttp v0.5.1
 	github.com/hashicorp/go-hclog v0.14.1
 	github.com/hashicorp/vault/api v1.0.4
 	github.com/hashicorp/vault/sdk v0.1.13
 	github.com/jeffchao/backoff v0.0.0-20140404060208-9d7fd7aa17f2
 	github.com/square/go-jose/v3 v3.0.0-20200630053402-0a67ce9b0693
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 )
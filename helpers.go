@@ -19,7 +19,11 @@ package dockerregistry
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"sort"
 	"strings"
 	"time"
@@ -67,19 +71,105 @@ func errMissingFields(f ...string) error {
 		"missing required field(s): %q", f))
 }
 
+// retry accepts a function and retries transient errors according to the
+// given policy strategy. The last error is always returned.
+func retry(ctx context.Context, p *RetryPolicy, op func() error) error {
+	if p.Strategy == retryStrategyExponential {
+		return retryExp(ctx, p, op)
+	}
+	return retryFib(ctx, p, op)
+}
+
 // retryFib accepts a function and retries using a fibonacci algorithm.
-func retryFib(op func() error) error {
+func retryFib(ctx context.Context, p *RetryPolicy, op func() error) error {
 	f := backoff.Fibonacci()
-	f.Interval = 100 * time.Millisecond
-	f.MaxRetries = 5
-	return f.Retry(op)
+	f.Interval = p.BaseInterval
+	f.MaxRetries = p.MaxAttempts - 1
+	return retryWithBackoff(ctx, p, func() (time.Duration, bool) {
+		if !f.Next() {
+			return 0, false
+		}
+		return f.Delay, true
+	}, op)
 }
 
 // retryExp accepts a function and retries using an exponential backoff
 // algorithm.
-func retryExp(op func() error) error {
+func retryExp(ctx context.Context, p *RetryPolicy, op func() error) error {
 	f := backoff.Exponential()
-	f.Interval = 100 * time.Millisecond
-	f.MaxRetries = 5
-	return f.Retry(op)
+	f.Interval = p.BaseInterval
+	f.MaxRetries = p.MaxAttempts - 1
+	return retryWithBackoff(ctx, p, func() (time.Duration, bool) {
+		if !f.Next() {
+			return 0, false
+		}
+		return f.Delay, true
+	}, op)
+}
+
+// retryWithBackoff calls op until it succeeds, fails with a non-transient
+// error, the backoff is exhausted or the context is done.
+func retryWithBackoff(ctx context.Context, p *RetryPolicy, next func() (time.Duration, bool), op func() error) error {
+	for {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		// Only retry transient errors
+		transient, retryAfter := isTransientError(err)
+		if !transient {
+			return err
+		}
+
+		backoffDelay, ok := next()
+		if !ok {
+			return err
+		}
+		delay, ok := p.delay(backoffDelay, retryAfter)
+		if !ok {
+			return err
+		}
+		emitRetry()
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isTransientError returns true if the error may succeed when retried: network
+// errors, registry throttling and server errors. The registry Retry-After
+// hint is returned when present.
+func isTransientError(err error) (bool, time.Duration) {
+	if errors.Is(err, context.Canceled) {
+		return false, 0
+	}
+
+	var re *RegistryError
+	if errors.As(err, &re) {
+		switch {
+		case re.StatusCode == http.StatusTooManyRequests,
+			re.StatusCode == http.StatusRequestTimeout,
+			re.StatusCode >= 500:
+			return true, re.RetryAfter
+		default:
+			return false, 0
+		}
+	}
+
+	// Unwrap the transport error to ignore TLS and URL errors
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		err = ue.Err
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true, 0
+	}
+
+	return false, 0
 }
@@ -0,0 +1,354 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/square/go-jose/v3"
+	"github.com/square/go-jose/v3/jwt"
+	"github.com/zntrio/vault-plugin-secrets-docker-registry/scope"
+)
+
+const testKeyID = "test-key"
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// testSigningKey returns the RSA key signing the test registry tokens.
+func testSigningKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	testKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		testKey = key
+	})
+	return testKey
+}
+
+// testJWKS returns the key set holding the test signing public key.
+func testJWKS(t *testing.T) string {
+	t.Helper()
+
+	keys := jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{
+			{Key: testSigningKey(t).Public(), KeyID: testKeyID, Algorithm: string(jose.RS256), Use: "sig"},
+		},
+	}
+	raw, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+// signTestToken returns a registry token signed with the test key.
+func signTestToken(t *testing.T, claims *jwtClaims) string {
+	t.Helper()
+	return signTestTokenWith(t, testSigningKey(t), testKeyID, claims)
+}
+
+// signTestTokenWith returns a registry token signed with the given key.
+func signTestTokenWith(t *testing.T, key *rsa.PrivateKey, kid string, claims *jwtClaims) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// -----------------------------------------------------------------------------
+
+// testRegistry is a fake docker registry with its token service. Tokens grant
+// the requested scopes and are signed with the test key.
+type testRegistry struct {
+	*httptest.Server
+	t *testing.T
+
+	mu sync.Mutex
+	// service is the advertised token service, issuer the token iss claim.
+	service string
+	issuer  string
+	// ttl is the lifetime of the issued tokens.
+	ttl time.Duration
+	// repositories are listed by the catalog and probed by HEAD requests.
+	repositories []string
+	// tokenFailures are the statuses returned by the next token requests,
+	// with the retryAfter header value.
+	tokenFailures []int
+	retryAfter    string
+	// catalogGate blocks catalog listings until closed, when set.
+	catalogGate chan struct{}
+	// grant filters the granted scopes, all requested ones when nil.
+	grant func(scopes []string) []string
+
+	tokenRequests   int
+	catalogRequests int
+	accounts        []string
+}
+
+// newTestRegistry starts a fake registry, closed with the test.
+func newTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+
+	r := &testRegistry{
+		t:       t,
+		service: "test-registry",
+		issuer:  "test-issuer",
+		ttl:     5 * time.Minute,
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.Close)
+
+	return r
+}
+
+func (r *testRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/v2/" || req.URL.Path == "/v2":
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="%s"`, r.URL, r.service))
+		w.WriteHeader(http.StatusUnauthorized)
+	case req.URL.Path == "/token":
+		r.serveToken(w, req)
+	case req.URL.Path == "/v2/_catalog":
+		r.mu.Lock()
+		r.catalogRequests++
+		gate, repositories := r.catalogGate, append([]string{}, r.repositories...)
+		r.mu.Unlock()
+		if gate != nil {
+			<-gate
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"repositories": repositories})
+	case strings.HasSuffix(req.URL.Path, "/manifests/latest"):
+		name := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v2/"), "/manifests/latest")
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for _, repository := range r.repositories {
+			if repository == name {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.tokenRequests++
+	account, _, _ := req.BasicAuth()
+	if req.Method == http.MethodPost {
+		_ = req.ParseForm()
+		account = req.PostForm.Get("username")
+	}
+	r.accounts = append(r.accounts, account)
+	if len(r.tokenFailures) > 0 {
+		status := r.tokenFailures[0]
+		r.tokenFailures = r.tokenFailures[1:]
+		if r.retryAfter != "" {
+			w.Header().Set("Retry-After", r.retryAfter)
+		}
+		r.mu.Unlock()
+		w.WriteHeader(status)
+		return
+	}
+	service, issuer, ttl, grant := r.service, r.issuer, r.ttl, r.grant
+	r.mu.Unlock()
+
+	// Requested scopes, several scope parameters may be sent
+	scopes := []string{}
+	for _, v := range req.URL.Query()["scope"] {
+		scopes = append(scopes, strings.Fields(v)...)
+	}
+	if grant != nil {
+		scopes = grant(scopes)
+	}
+	access := []jwtAccess{}
+	for _, raw := range scopes {
+		s, err := scope.Parse(raw)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		access = append(access, jwtAccess{Type: s.Type, Class: s.Class, Name: s.Name, Actions: s.Actions})
+	}
+
+	now := time.Now()
+	token := signTestToken(r.t, &jwtClaims{
+		Claims: jwt.Claims{
+			Issuer:   issuer,
+			Subject:  account,
+			Audience: jwt.Audience{service},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(ttl)),
+			ID:       fmt.Sprintf("jti-%d", now.UnixNano()),
+		},
+		Access: access,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_in": int(ttl.Seconds()),
+	})
+}
+
+// counters returns the number of token and catalog requests served.
+func (r *testRegistry) counters() (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tokenRequests, r.catalogRequests
+}
+
+// -----------------------------------------------------------------------------
+
+// testRevokingClient records the revoked tokens of a registry client.
+type testRevokingClient struct {
+	RegistryClient
+
+	mu      sync.Mutex
+	revoked []string
+}
+
+func (c *testRevokingClient) Revoke(_ context.Context, rt *RegistryToken) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.revoked = append(c.revoked, rt.Claims.ID)
+	return nil
+}
+
+func (c *testRevokingClient) revokedTokens() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.revoked...)
+}
+
+// testBackend returns a backend configured against the given registry, its
+// storage and the registry client recording revocations.
+func testBackend(t *testing.T, r *testRegistry, config map[string]interface{}) (*backend, logical.Storage, *testRevokingClient) {
+	t.Helper()
+
+	client := &testRevokingClient{}
+	b := newBackend(func(hc *http.Client) RegistryClient {
+		client.RegistryClient = NewRegistryClient(hc)
+		return client
+	})
+
+	conf := logical.TestBackendConfig()
+	conf.StorageView = &logical.InmemStorage{}
+	if err := b.Setup(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.clean(context.Background()) })
+
+	data := map[string]interface{}{
+		"registry_url":        r.URL,
+		"username":            "mount",
+		"password":            "mount-secret",
+		"retry_base_interval": "1ms",
+		"retry_max_interval":  "10ms",
+	}
+	for k, v := range config {
+		data[k] = v
+	}
+	testRequest(t, b, conf.StorageView, logical.UpdateOperation, "config", data)
+
+	return b, conf.StorageView, client
+}
+
+// testRequest sends a request to the backend and fails the test on error.
+func testRequest(t *testing.T, b *backend, s logical.Storage, op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+	t.Helper()
+
+	resp, err := testHandle(b, s, op, path, data)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("%s %s: %v, %#v", op, path, err, resp)
+	}
+	return resp
+}
+
+// testHandle sends a request to the backend.
+func testHandle(b *backend, s logical.Storage, op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation:  op,
+		Path:       path,
+		Data:       data,
+		Storage:    s,
+		MountPoint: "docker-registry/",
+		EntityID:   "entity-1",
+	})
+}
+
+// testSecretRequest sends a lease renewal or revocation request to the
+// backend. The lease internal data goes through JSON as it does in the Vault
+// storage.
+func testSecretRequest(t *testing.T, b *backend, s logical.Storage, op logical.Operation, secret *logical.Secret) (*logical.Response, error) {
+	t.Helper()
+
+	payload, err := json.Marshal(secret.InternalData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := *secret
+	stored.InternalData = nil
+	if err := json.Unmarshal(payload, &stored.InternalData); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation:  op,
+		Secret:     &stored,
+		Storage:    s,
+		MountPoint: "docker-registry/",
+	})
+}
+
+// testErrorCode returns the HTTP status Vault would respond with, 0 when the
+// request succeeded.
+func testErrorCode(resp *logical.Response, err error) int {
+	if coded, ok := err.(logical.HTTPCodedError); ok {
+		return coded.Code()
+	}
+	code, _ := logical.RespondErrorCommon(&logical.Request{}, resp, err)
+	return code
+}
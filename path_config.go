@@ -36,10 +36,20 @@ func (b *backend) pathConfig() []*framework.Path {
 				"or manage the requested scope(s).",
 
 			Fields: map[string]*framework.FieldSchema{
+				"registry_url": {
+					Type:        framework.TypeString,
+					Description: `The registry host or URL (e.g. ghcr.io), used to discover the token service.`,
+					Default:     defaultRegistryURL,
+				},
 				"endpoint_url": {
 					Type:        framework.TypeString,
-					Description: `The registry URL base endpoint where token request will be sent to.`,
-					Required:    true,
+					Description: `Optional token service base endpoint, overrides the realm discovered from the registry.`,
+				},
+				"token_flow": {
+					Type:          framework.TypeString,
+					Description:   `Token request flow, "basic" for the legacy GET request or "oauth2" for the POST OAuth2 request.`,
+					Default:       tokenFlowBasic,
+					AllowedValues: []interface{}{tokenFlowBasic, tokenFlowOAuth2},
 				},
 				"client_id": {
 					Type:        framework.TypeLowerCaseString,
@@ -53,6 +63,128 @@ func (b *backend) pathConfig() []*framework.Path {
 					Type:        framework.TypeString,
 					Description: `The registry identity password.`,
 				},
+				"refresh_token": {
+					Type:        framework.TypeString,
+					Description: `The registry identity token, used with the refresh_token grant of the oauth2 flow instead of the password.`,
+				},
+				"trusted_certificates": {
+					Type:        framework.TypeString,
+					Description: `PEM bundle of the certificates trusted to sign registry tokens (x5c chain roots or signing certificates). Token signatures are not verified when neither this nor jwks is set.`,
+				},
+				"jwks": {
+					Type:        framework.TypeString,
+					Description: `JSON Web Key Set document of the keys trusted to sign registry tokens.`,
+				},
+				"token_issuer": {
+					Type:        framework.TypeString,
+					Description: `Expected registry token issuer (iss claim), checked even without trusted material, not checked when empty.`,
+				},
+				"clock_skew": {
+					Type:        framework.TypeDurationSecond,
+					Description: `Clock skew allowance used to validate the registry token validity window.`,
+					Default:     int(defaultClockSkew.Seconds()),
+				},
+				"catalog_refresh_interval": {
+					Type:        framework.TypeDurationSecond,
+					Description: `Refresh interval of the cached registry catalog used to expand repository scope patterns, the catalog is listed on each request when 0.`,
+					Default:     int(defaultCatalogRefreshInterval.Seconds()),
+				},
+				"max_scope_expansion": {
+					Type:        framework.TypeInt,
+					Description: `Maximum number of repositories a role scope patterns can expand to.`,
+					Default:     defaultMaxScopeExpansion,
+				},
+				"health_check_interval": {
+					Type:        framework.TypeDurationSecond,
+					Description: `Interval of the scheduled credential health probe, disabled when 0.`,
+					Default:     int(defaultHealthCheckInterval.Seconds()),
+				},
+				"upstream_rate_limit": {
+					Type:        framework.TypeInt,
+					Description: `Budget of upstream registry requests per minute for the mount, disabled when 0.`,
+				},
+				"upstream_burst": {
+					Type:        framework.TypeInt,
+					Description: `Number of upstream registry requests allowed at once when the budget is enabled.`,
+					Default:     defaultUpstreamBurst,
+				},
+				"ca_certificate": {
+					Type:        framework.TypeString,
+					Description: `PEM bundle of additional CA certificates trusted for registry TLS connections.`,
+				},
+				"client_certificate": {
+					Type:        framework.TypeString,
+					Description: `PEM client certificate presented to the registry for mutual TLS.`,
+				},
+				"client_key": {
+					Type:        framework.TypeString,
+					Description: `PEM private key of the client certificate.`,
+				},
+				"tls_min_version": {
+					Type:          framework.TypeString,
+					Description:   `Minimum TLS version used to connect to the registry.`,
+					Default:       defaultTLSMinVersion,
+					AllowedValues: []interface{}{"tls10", "tls11", "tls12", "tls13"},
+				},
+				"proxy_url": {
+					Type:        framework.TypeString,
+					Description: `HTTP proxy URL used to reach the registry, environment proxy settings are used when empty.`,
+				},
+				"no_proxy": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: `Hosts, domains or CIDRs that must not use the proxy_url.`,
+				},
+				"insecure_skip_verify": {
+					Type:        framework.TypeBool,
+					Description: `Disable registry TLS certificate verification. For development only.`,
+				},
+				"retry_max_attempts": {
+					Type:        framework.TypeInt,
+					Description: `Maximum number of token request attempts.`,
+					Default:     defaultRetryMaxAttempts,
+				},
+				"retry_base_interval": {
+					Type:        framework.TypeString,
+					Description: `Base backoff interval between token request attempts, as a Go duration (e.g. 100ms).`,
+					Default:     defaultRetryBaseInterval.String(),
+				},
+				"retry_max_interval": {
+					Type:        framework.TypeString,
+					Description: `Maximum backoff interval between token request attempts, as a Go duration (e.g. 5s). Retry-After hints above it stop the retries.`,
+					Default:     defaultRetryMaxInterval.String(),
+				},
+				"retry_jitter": {
+					Type:        framework.TypeBool,
+					Description: `Randomize the backoff interval between token request attempts.`,
+					Default:     true,
+				},
+				"retry_strategy": {
+					Type:          framework.TypeString,
+					Description:   `Backoff algorithm used between token request attempts.`,
+					Default:       retryStrategyFibonacci,
+					AllowedValues: []interface{}{retryStrategyFibonacci, retryStrategyExponential},
+				},
+				"rotation_provider": {
+					Type:          framework.TypeString,
+					Description:   `Upstream used by rotate-root to issue a new registry secret: harbor, dockerhub or webhook.`,
+					AllowedValues: []interface{}{rotationProviderNone, rotationProviderHarbor, rotationProviderDockerHub, rotationProviderWebhook},
+				},
+				"rotation_url": {
+					Type:        framework.TypeString,
+					Description: `Rotation provider base URL. Defaults to the registry_url for harbor and to Docker Hub for dockerhub, required for webhook.`,
+				},
+				"rotation_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: `Period of the scheduled registry secret rotation, disabled when 0.`,
+				},
+				"harbor_robot_id": {
+					Type:        framework.TypeInt,
+					Description: `Harbor robot account identifier, required by the harbor rotation provider.`,
+				},
+				"dockerhub_token_id": {
+					Type:        framework.TypeString,
+					Description: `UUID of the Docker Hub access token used as password, deleted after a successful rotation.`,
+				},
 			},
 
 			ExistenceCheck: b.pathConfigExists,
@@ -95,12 +227,17 @@ func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, _ *f
 // pathConfigWrite corresponds to both CREATE and UPDATE docker-registry/config and is
 // used to create or update the current configuration.
 func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
 	// Get the current configuration, if it exists
 	c, err := b.Config(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
 
+	previous := c.clone()
+
 	// Update the configuration
 	changed, err := c.Update(d)
 	if err != nil {
@@ -119,6 +256,23 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *
 		if err := req.Storage.Put(ctx, entry); err != nil {
 			return nil, errwrap.Wrapf("failed to persist configuration to storage: {{err}}", err)
 		}
+		b.setConfig(c)
+
+		// A pending rotated secret is obsolete once the credential is replaced
+		if c.RegistryURL != previous.RegistryURL || c.Username != previous.Username || c.Password != previous.Password {
+			if err := b.deletePendingSecret(ctx, req.Storage); err != nil {
+				return nil, err
+			}
+		}
+
+		// Rebuild the registry client if transport settings changed
+		if _, err := b.Client(c); err != nil {
+			return nil, err
+		}
+
+		// Registry or credentials may have changed
+		b.resetCatalog()
+		b.tokenCache.reset()
 	}
 
 	return nil, nil
@@ -127,9 +281,18 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *
 // pathConfigDelete corresponds to DELETE docker-registry/config and is used to delete
 // all the configuration.
 func (b *backend) pathConfigDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
 	if err := req.Storage.Delete(ctx, "config"); err != nil {
 		return nil, errwrap.Wrapf("failed to delete from storage: {{err}}", err)
 	}
+	if err := b.deletePendingSecret(ctx, req.Storage); err != nil {
+		return nil, err
+	}
+	b.setConfig(nil)
+	b.resetCatalog()
+	b.tokenCache.reset()
 
 	return nil, nil
 }
@@ -0,0 +1,96 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathConfigRateLimit defines the upstream quota path.
+func (b *backend) pathConfigRateLimit() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern:         "config/ratelimit",
+			HelpSynopsis:    "Read the registry upstream quota",
+			HelpDescription: "Return the quota advertised by the registry RateLimit headers, probed with the ratelimitpreview/test repository when none was observed, and the mount upstream request budget.",
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: withFieldValidator(b.pathConfigRateLimitRead),
+			},
+		},
+	}
+}
+
+// pathConfigRateLimitRead corresponds to READ docker-registry/config/ratelimit
+// and is used to read the remaining upstream quota.
+func (b *backend) pathConfigRateLimitRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	engine, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	client, err := b.Client(engine)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"registry_url":        engine.RegistryURL,
+			"upstream_rate_limit": engine.UpstreamRateLimit,
+			"upstream_burst":      engine.upstreamBurst(),
+			"probed":              false,
+		},
+	}
+
+	// Probe the registry when no quota was observed
+	status := client.RateLimit(engine.RegistryURL)
+	if status == nil {
+		authorization, err := b.registryAuthorization(ctx, engine, client, []string{fmt.Sprintf("repository:%s:pull", rateLimitProbeRepository)})
+		if err == nil {
+			status, err = client.ProbeRateLimit(ctx, engine.RegistryURL, authorization)
+		}
+
+		// Registries other than Docker Hub don't host the probe repository
+		var re *RegistryError
+		if errors.As(err, &re) && re.StatusCode == http.StatusNotFound {
+			status, err = nil, nil
+		}
+		if err != nil {
+			if coded := codedRegistryError(err); coded != err {
+				return nil, coded
+			}
+			return nil, errwrap.Wrapf("unable to probe registry rate limit: {{err}}", err)
+		}
+		resp.Data["probed"] = true
+	}
+
+	if status == nil {
+		resp.AddWarning("the registry does not advertise any rate limit")
+		return resp, nil
+	}
+	resp.Data["upstream"] = status.AsMap()
+
+	return resp, nil
+}
@@ -0,0 +1,258 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	healthStatusPath = "health/status"
+)
+
+// HealthStatus is the stored result of the registry credential probes.
+type HealthStatus struct {
+	LastCheck           time.Time `json:"last_check"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error"`
+	LastErrorAt         time.Time `json:"last_error_at"`
+	LastStatusCode      int       `json:"last_status_code"`
+	LastLatency         int64     `json:"last_latency_ms"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+// AsMap returns health status as map.
+func (hs *HealthStatus) AsMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"last_error":           hs.LastError,
+		"last_status_code":     hs.LastStatusCode,
+		"last_latency_ms":      hs.LastLatency,
+		"consecutive_failures": hs.ConsecutiveFailures,
+		"healthy":              !hs.LastCheck.IsZero() && hs.ConsecutiveFailures == 0,
+	}
+	if !hs.LastCheck.IsZero() {
+		m["last_check"] = hs.LastCheck.UTC()
+	}
+	if !hs.LastSuccess.IsZero() {
+		m["last_success"] = hs.LastSuccess.UTC()
+	}
+	if !hs.LastErrorAt.IsZero() {
+		m["last_error_at"] = hs.LastErrorAt.UTC()
+	}
+	return m
+}
+
+// credentialProbe is the result of a registry credential check.
+type credentialProbe struct {
+	token      *RegistryToken
+	statusCode int
+	latency    time.Duration
+	err        error
+}
+
+// pathConfigStatus defines the credential verification and health paths.
+func (b *backend) pathConfigStatus() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern:         "config/verify",
+			HelpSynopsis:    "Verify the mount registry credential",
+			HelpDescription: "Send a token request without scope with the stored credentials, and report the latency, the HTTP status and the granted claims. The result is recorded in the health status.",
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: withFieldValidator(b.pathConfigVerifyUpdate),
+			},
+		},
+		{
+			Pattern:         "config/status",
+			HelpSynopsis:    "Read the mount registry credential health",
+			HelpDescription: "Return the outcome of the last credential verifications, run by config/verify or on schedule according to health_check_interval.",
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: withFieldValidator(b.pathConfigStatusRead),
+			},
+		},
+	}
+}
+
+// pathConfigVerifyUpdate corresponds to UPDATE docker-registry/config/verify
+// and is used to check the stored registry credential.
+func (b *backend) pathConfigVerifyUpdate(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	engine, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	probe := b.probeCredentials(ctx, engine)
+	if _, err := b.recordHealth(ctx, req.Storage, probe); err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{
+		"valid":        probe.err == nil,
+		"registry_url": engine.RegistryURL,
+		"status_code":  probe.statusCode,
+		"latency_ms":   probe.latency.Milliseconds(),
+	}
+	if probe.err != nil {
+		data["error"] = probe.err.Error()
+	}
+	if probe.token != nil {
+		data["realm"] = probe.token.Realm
+		data["service"] = probe.token.Service
+		data["issued_at"] = probe.token.IssuedAt.UTC()
+		data["expires_at"] = probe.token.ExpiresAt.UTC()
+		data["claims"] = probe.token.Claims.AsMap()
+	}
+
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+// pathConfigStatusRead corresponds to READ docker-registry/config/status and
+// is used to read the credential health status.
+func (b *backend) pathConfigStatusRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	status, err := b.HealthStatus(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: status.AsMap(),
+	}, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// HealthStatus returns the credential health status from the storage backend.
+func (b *backend) HealthStatus(ctx context.Context, s logical.Storage) (*HealthStatus, error) {
+	status := &HealthStatus{}
+
+	entry, err := s.Get(ctx, healthStatusPath)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to get health status from storage: {{err}}", err)
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return status, nil
+	}
+
+	if err := entry.DecodeJSON(status); err != nil {
+		return nil, errwrap.Wrapf("failed to decode health status: {{err}}", err)
+	}
+	return status, nil
+}
+
+func (b *backend) putHealthStatus(ctx context.Context, s logical.Storage, status *HealthStatus) error {
+	entry, err := logical.StorageEntryJSON(healthStatusPath, status)
+	if err != nil {
+		return errwrap.Wrapf("failed to generate JSON health status: {{err}}", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("failed to persist health status to storage: {{err}}", err)
+	}
+	return nil
+}
+
+// probeCredentials checks the configuration credentials and measures the
+// token request.
+func (b *backend) probeCredentials(ctx context.Context, engine *Config) *credentialProbe {
+	start := time.Now()
+	t, err := b.verifyCredentials(ctx, engine)
+	probe := &credentialProbe{
+		token:   t,
+		latency: time.Since(start),
+		err:     err,
+	}
+
+	var re *RegistryError
+	switch {
+	case err == nil:
+		probe.statusCode = http.StatusOK
+	case errors.As(err, &re):
+		probe.statusCode = re.StatusCode
+	}
+
+	return probe
+}
+
+// recordHealth updates the stored health status with the probe outcome.
+func (b *backend) recordHealth(ctx context.Context, s logical.Storage, probe *credentialProbe) (*HealthStatus, error) {
+	status, err := b.HealthStatus(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	status.LastCheck = now
+	status.LastStatusCode = probe.statusCode
+	status.LastLatency = probe.latency.Milliseconds()
+	if probe.err != nil {
+		status.LastError = probe.err.Error()
+		status.LastErrorAt = now
+		status.ConsecutiveFailures++
+	} else {
+		status.LastSuccess = now
+		status.LastError = ""
+		status.ConsecutiveFailures = 0
+	}
+
+	if err := b.putHealthStatus(ctx, s, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// periodicHealthCheck probes the registry credential when the health check
+// interval has elapsed.
+func (b *backend) periodicHealthCheck(ctx context.Context, s logical.Storage) error {
+	engine, err := b.Config(ctx, s)
+	if err != nil {
+		return err
+	}
+	if engine.HealthCheckInterval <= 0 {
+		return nil
+	}
+
+	// Nothing to check on unconfigured mounts
+	entry, err := s.Get(ctx, "config")
+	if err != nil || entry == nil {
+		return err
+	}
+
+	status, err := b.HealthStatus(ctx, s)
+	if err != nil {
+		return err
+	}
+	if time.Since(status.LastCheck) < engine.HealthCheckInterval {
+		return nil
+	}
+
+	probe := b.probeCredentials(ctx, engine)
+	if probe.err != nil {
+		b.Logger().Warn("registry credential health check failed", "error", probe.err)
+	}
+	_, err = b.recordHealth(ctx, s, probe)
+	return err
+}
@@ -19,7 +19,10 @@ package dockerregistry
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
@@ -66,20 +69,295 @@ func (b *backend) credReadOperation(ctx context.Context, req *logical.Request, f
 	if err != nil {
 		return nil, err
 	}
+	if role == nil {
+		return nil, logical.CodedError(http.StatusNotFound, fmt.Sprintf("unknown role %q", roleName))
+	}
+
+	return b.roleCreds(ctx, req, engine, role)
+}
+
+// roleCreds issues the credentials of the given role within its quotas.
+func (b *backend) roleCreds(ctx context.Context, req *logical.Request, engine *Config, role *Role) (*logical.Response, error) {
+	release, err := b.consumeQuotas(ctx, req, role)
+	if err != nil {
+		emitIssuance(role.Name, err)
+		return nil, err
+	}
+
+	resp, err := b.issueRoleCreds(ctx, engine, role)
+	emitIssuance(role.Name, err)
+	if err != nil {
+		release()
+		return nil, err
+	}
 
-	// Get token (and retry)
-	var t *RegistryToken
-	if retryFib(func() error {
-		var err error
-		// Use client to retrieve an access token
-		t, err = b.client.Token(ctx, engine.EndpointURL, engine.ClientID, engine.Username, engine.Password, role.Service, strings.Join(role.Scopes, " "))
-		return err
-	}); err != nil {
-		return nil, errwrap.Wrapf("unable to retrieve token: {{err}}", err)
+	return resp, nil
+}
+
+// issueRoleCreds issues the credentials of the given role.
+func (b *backend) issueRoleCreds(ctx context.Context, engine *Config, role *Role) (*logical.Response, error) {
+	// Static credentials
+	if role.roleType() == roleTypeBasic {
+		return credBasicResponse(engine, role)
+	}
+
+	// Registry client
+	client, err := b.Client(engine)
+	if err != nil {
+		return nil, err
+	}
+
+	// Multiple registries
+	if len(role.Registries) > 0 {
+		return b.credMultiResponse(ctx, engine, client, role)
+	}
+
+	// Issue registry token
+	t, expanded, cached, err := b.roleToken(ctx, engine, client, role, role.Service, role.Scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Issue the token as a lease
+	resp := b.Secret(secretTokenType).Response(t.AsMap(), tokenLeaseInternalData(role.Name, t))
+	resp.Secret.TTL, resp.Secret.MaxTTL = role.LeaseTTL(t.ExpiresAt)
+	resp.Secret.InternalData["shared"] = role.Cache || t.shared
+	resp.Data["type"] = roleTypeToken
+	resp.Data["cached"] = cached
+	if expanded != nil {
+		resp.Data["expanded_repositories"] = expanded
+	}
+
+	// Compare granted scopes
+	if err := enforceScopes(resp, role.Name, role.scopeEnforcement(), t); err != nil {
+		return nil, err
 	}
 
 	// No error
+	return resp, nil
+}
+
+// credMultiResponse issues the tokens of a multi-registry role concurrently,
+// as a single lease. Failed registries either fail the request or are reported
+// according to the role partial failure mode.
+func (b *backend) credMultiResponse(ctx context.Context, engine *Config, client RegistryClient, role *Role) (*logical.Response, error) {
+	type result struct {
+		registryURL string
+		token       *RegistryToken
+		expanded    map[string][]string
+		cached      bool
+		err         error
+	}
+
+	results := make([]result, len(role.Registries))
+	var wg sync.WaitGroup
+	for i, rr := range role.Registries {
+		wg.Add(1)
+		go func(i int, rr RoleRegistry) {
+			defer wg.Done()
+
+			target := engine.ForRegistry(&rr)
+			res := result{registryURL: target.RegistryURL}
+			res.token, res.expanded, res.cached, res.err = b.roleToken(ctx, target, client, role, rr.Service, rr.Scopes)
+			results[i] = res
+		}(i, rr)
+	}
+	wg.Wait()
+
+	registries := map[string]interface{}{}
+	issued, leased := []*RegistryToken{}, []*RegistryToken{}
+	warnings := []string{}
+	var firstErr error
+	for _, res := range results {
+		var entry *logical.Response
+		if res.token != nil {
+			issued = append(issued, res.token)
+
+			// Compare granted scopes of each token
+			entry = &logical.Response{Data: res.token.AsMap()}
+			entry.Data["cached"] = res.cached
+			if res.expanded != nil {
+				entry.Data["expanded_repositories"] = res.expanded
+			}
+			res.err = enforceScopes(entry, role.Name, role.scopeEnforcement(), res.token)
+		}
+
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			registries[res.registryURL] = map[string]interface{}{
+				"error": res.err.Error(),
+			}
+			warnings = append(warnings, fmt.Sprintf("%s: %v", res.registryURL, res.err))
+			continue
+		}
+
+		leased = append(leased, res.token)
+		registries[res.registryURL] = entry.Data
+		for _, w := range entry.Warnings {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", res.registryURL, w))
+		}
+	}
+
+	// Drop issued tokens when the request fails, cached tokens are shared
+	if firstErr != nil && (role.partialFailure() == partialFailureFail || len(leased) == 0) {
+		if !role.Cache {
+			b.revokeTokens(ctx, client, issued)
+		}
+		return nil, firstErr
+	}
+
+	// Issue the tokens as a single lease
+	resp := b.Secret(secretTokenType).Response(map[string]interface{}{
+		"type":       roleTypeToken,
+		"registries": registries,
+	}, multiTokenLeaseInternalData(role.Name, leased))
+	resp.Secret.TTL, resp.Secret.MaxTTL = role.LeaseTTL(earliestExpiration(leased))
+	resp.Secret.InternalData["shared"] = role.Cache
+	for _, w := range warnings {
+		resp.AddWarning(w)
+	}
+
+	return resp, nil
+}
+
+// credBasicResponse returns the static credentials of a basic role. These
+// credentials are not issued as a lease since they can't be revoked.
+func credBasicResponse(engine *Config, role *Role) (*logical.Response, error) {
+	username, password := role.Username, role.Password
+	if username == "" {
+		username = engine.Username
+	}
+	if password == "" {
+		password = engine.Password
+	}
+	if username == "" || password == "" {
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("role %q has no basic credentials configured", role.Name))
+	}
+
 	return &logical.Response{
-		Data: t.AsMap(),
+		Data: map[string]interface{}{
+			"type":         roleTypeBasic,
+			"registry_url": engine.RegistryURL,
+			"username":     username,
+			"password":     password,
+		},
 	}, nil
 }
+
+// enforceScopes compares the token granted scopes with the requested ones
+// according to the role enforcement mode. Mismatches are counted whatever the
+// mode.
+func enforceScopes(resp *logical.Response, roleName, mode string, t *RegistryToken) error {
+	diff := diffScopes(t.RequestScopes, t.TokenScopes)
+	if diff.Empty() {
+		return nil
+	}
+	emitScopeMismatch(roleName, mode)
+
+	if mode == scopeEnforcementIgnore {
+		return nil
+	}
+
+	if mode == scopeEnforcementStrict {
+		return logical.CodedError(http.StatusForbidden, fmt.Sprintf("%s: registry granted partial scopes: %s", logical.ErrPermissionDenied, strings.Join(diff.Messages(), "; ")))
+	}
+
+	resp.Data["scope_diff"] = diff.AsMap()
+	for _, msg := range diff.Messages() {
+		resp.AddWarning(msg)
+	}
+
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// issueToken requests a registry token for the given service and scopes,
+// repository scope patterns are expanded beforehand.
+func (b *backend) issueToken(ctx context.Context, engine *Config, client RegistryClient, service string, scopes []string, offline bool) (*RegistryToken, map[string][]string, error) {
+	// Resolve token service
+	realm, service, err := b.resolveTokenService(ctx, client, engine, service)
+	if err != nil {
+		if coded := codedRegistryError(err); coded != err {
+			return nil, nil, coded
+		}
+		return nil, nil, errwrap.Wrapf("unable to resolve token service: {{err}}", err)
+	}
+
+	// Expand repository scope patterns
+	scopes, expanded, err := b.expandScopes(ctx, engine, client, scopes)
+	if err != nil {
+		if _, ok := err.(logical.HTTPCodedError); ok {
+			return nil, nil, err
+		}
+		if coded := codedRegistryError(err); coded != err {
+			return nil, nil, coded
+		}
+		return nil, nil, errwrap.Wrapf("unable to expand role scopes: {{err}}", err)
+	}
+
+	// Prepare token request
+	tr, err := engine.TokenRequest(realm, service, scopes)
+	if err != nil {
+		return nil, nil, errwrap.Wrapf("unable to prepare token request: {{err}}", err)
+	}
+	tr.Offline = offline
+
+	// Get token (and retry), merged with identical in-flight requests
+	t, shared, err := b.tokenFlights.do(ctx, b.ctx, tr.Key(), func(ctx context.Context) (*RegistryToken, error) {
+		var t *RegistryToken
+		err := retry(ctx, &engine.RetryPolicy, func() error {
+			var err error
+			// Use client to retrieve an access token
+			t, err = client.Token(ctx, tr)
+			return err
+		})
+		return t, err
+	})
+	if err != nil {
+		if coded := codedRegistryError(err); coded != err {
+			return nil, nil, coded
+		}
+		return nil, nil, errwrap.Wrapf("unable to retrieve token: {{err}}", err)
+	}
+	t.RegistryURL = engine.RegistryURL
+	t.shared = shared
+
+	return t, expanded, nil
+}
+
+// resolveTokenService returns the token realm and service to use for a token
+// request. Values not explicitly configured are discovered from the registry
+// authentication challenge.
+func (b *backend) resolveTokenService(ctx context.Context, client RegistryClient, engine *Config, roleService string) (string, string, error) {
+	realm, service := engine.TokenRealm(), roleService
+	if realm != "" && service != "" {
+		return realm, service, nil
+	}
+
+	// Discover from registry
+	challenge, err := client.Challenge(ctx, engine.RegistryURL)
+	if err != nil {
+		return "", "", err
+	}
+	if challenge.Scheme == challengeSchemeBasic {
+		return "", "", fmt.Errorf("registry %q requires basic authentication, use a %q role", engine.RegistryURL, roleTypeBasic)
+	}
+	if !challenge.IsBearer() {
+		return "", "", fmt.Errorf("registry %q does not advertise a bearer token service", engine.RegistryURL)
+	}
+	if challenge.Realm == "" {
+		return "", "", fmt.Errorf("registry %q challenge has no realm", engine.RegistryURL)
+	}
+
+	if realm == "" {
+		realm = challenge.Realm
+	}
+	if service == "" {
+		service = challenge.Service
+	}
+
+	return realm, service, nil
+}
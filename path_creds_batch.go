@@ -0,0 +1,171 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	credsBatchPath = "creds-batch"
+
+	// credsBatchWorkers bounds the number of roles processed concurrently.
+	credsBatchWorkers = 4
+	// credsBatchMaxRoles bounds the number of roles of a single request.
+	credsBatchMaxRoles = 50
+)
+
+func (b *backend) pathCredsBatch() []*framework.Path {
+	roleName := `\w(([\w-.]+)?\w)?`
+	return []*framework.Path{
+		{
+			Pattern:         credsBatchPath + "/(?P<roles>" + roleName + "(," + roleName + ")*)",
+			HelpSynopsis:    `Retrieve the creds of several roles.`,
+			HelpDescription: `Issue the credentials of the comma separated roles of the path in a single request. The roles are part of the path so that policies grant explicit role combinations. Registry tokens of all roles are issued as a single lease.`,
+
+			Fields: map[string]*framework.FieldSchema{
+				"roles": {
+					Type:        framework.TypeString,
+					Description: "Comma separated names of the roles",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: withFieldValidator(b.credsBatchReadOperation),
+			},
+		},
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// credsBatchReadOperation issues the credentials of several roles. The role
+// names are part of the request path, so the ACL check of the request covers
+// the requested roles.
+func (b *backend) credsBatchReadOperation(ctx context.Context, req *logical.Request, fieldData *framework.FieldData) (*logical.Response, error) {
+	// Deduplicate role names
+	roleNames := []string{}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(fieldData.Get("roles").(string), ",") {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		roleNames = append(roleNames, name)
+	}
+	if len(roleNames) > credsBatchMaxRoles {
+		return nil, logical.CodedError(400, fmt.Sprintf("too many roles requested, at most %d are allowed", credsBatchMaxRoles))
+	}
+
+	// Engine configuration, shared by all roles
+	engine, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		entry  map[string]interface{}
+		secret *logical.Secret
+	}
+	results := make([]result, len(roleNames))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < credsBatchWorkers && w < len(roleNames); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i].entry, results[i].secret = b.credsBatchEntry(ctx, req, engine, roleNames[i])
+			}
+		}()
+	}
+	for i := range roleNames {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	roles := map[string]interface{}{}
+	leased := []map[string]interface{}{}
+	var ttl, maxTTL time.Duration
+	for i, name := range roleNames {
+		roles[name] = results[i].entry
+
+		// Merge the role leases, the batch lease ends with the first one
+		if secret := results[i].secret; secret != nil {
+			if len(leased) == 0 || secret.TTL < ttl {
+				ttl = secret.TTL
+			}
+			if len(leased) == 0 || secret.MaxTTL < maxTTL {
+				maxTTL = secret.MaxTTL
+			}
+			leased = append(leased, secret.InternalData)
+		}
+	}
+
+	data := map[string]interface{}{
+		"roles": roles,
+	}
+	if len(leased) == 0 {
+		return &logical.Response{Data: data}, nil
+	}
+
+	// Issue the tokens of all roles as a single lease
+	resp := b.Secret(secretTokenType).Response(data, batchLeaseInternalData(leased))
+	resp.Secret.TTL, resp.Secret.MaxTTL = ttl, maxTTL
+
+	return resp, nil
+}
+
+// credsBatchEntry issues the credentials of a single role of a batch, errors
+// are reported in the entry. The returned secret holds the role lease, nil for
+// basic roles.
+func (b *backend) credsBatchEntry(ctx context.Context, req *logical.Request, engine *Config, roleName string) (map[string]interface{}, *logical.Secret) {
+	role, err := b.Role(ctx, req.Storage, roleName)
+	if err == nil && role == nil {
+		err = fmt.Errorf("unknown role %q", roleName)
+	}
+	if err != nil {
+		return map[string]interface{}{
+			"error": err.Error(),
+		}, nil
+	}
+
+	resp, err := b.roleCreds(ctx, req, engine, role)
+	if err != nil {
+		return map[string]interface{}{
+			"error": err.Error(),
+		}, nil
+	}
+
+	entry := resp.Data
+	if len(resp.Warnings) > 0 {
+		entry["warnings"] = resp.Warnings
+	}
+	if resp.Secret != nil {
+		delete(resp.Secret.InternalData, "secret_type")
+	}
+	return entry, resp.Secret
+}
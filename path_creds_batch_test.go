@@ -0,0 +1,110 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestCredsBatch(t *testing.T) {
+	r := newTestRegistry(t)
+	b, s, client := testBackend(t, r, nil)
+
+	testRequest(t, b, s, logical.CreateOperation, "roles/pull", map[string]interface{}{
+		"scopes": []string{"repository:team-a/api:pull"},
+		"ttl":    "1m",
+	})
+	testRequest(t, b, s, logical.CreateOperation, "roles/shared", map[string]interface{}{
+		"scopes": []string{"repository:team-a/web:pull"},
+		"cache":  true,
+	})
+	testRequest(t, b, s, logical.CreateOperation, "roles/nexus", map[string]interface{}{
+		"type":     roleTypeBasic,
+		"username": "ci",
+		"password": "ci-secret",
+	})
+
+	resp := testRequest(t, b, s, logical.ReadOperation, "creds-batch/pull,shared,nexus,missing", nil)
+	roles := resp.Data["roles"].(map[string]interface{})
+	for _, name := range []string{"pull", "shared", "nexus"} {
+		entry := roles[name].(map[string]interface{})
+		if msg, ok := entry["error"]; ok {
+			t.Fatalf("role %s failed: %v", name, msg)
+		}
+	}
+	if _, ok := roles["missing"].(map[string]interface{})["error"]; !ok {
+		t.Fatalf("expected an error entry for an unknown role: %#v", roles["missing"])
+	}
+
+	// A single lease, capped by the shortest role lease
+	if resp.Secret == nil {
+		t.Fatal("expected a lease for the batch")
+	}
+	if resp.Secret.TTL > time.Minute {
+		t.Fatalf("expected the lease TTL capped by the role ttl, got %s", resp.Secret.TTL)
+	}
+
+	// Renewal follows the same cap
+	renewed, err := testSecretRequest(t, b, s, logical.RenewOperation, resp.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Secret.TTL > time.Minute {
+		t.Fatalf("expected the renewed TTL capped by the role ttl, got %s", renewed.Secret.TTL)
+	}
+
+	// Only the token of the role without cache is revoked
+	if _, err := testSecretRequest(t, b, s, logical.RevokeOperation, resp.Secret); err != nil {
+		t.Fatal(err)
+	}
+	claims := roles["pull"].(map[string]interface{})["claims"].(map[string]interface{})
+	if got, want := client.revokedTokens(), []string{claims["jti"].(string)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("revoked tokens = %v, want %v", got, want)
+	}
+}
+
+func TestCredsBatchPath(t *testing.T) {
+	r := newTestRegistry(t)
+	b, s, _ := testBackend(t, r, nil)
+
+	testRequest(t, b, s, logical.CreateOperation, "roles/nexus", map[string]interface{}{
+		"type":     roleTypeBasic,
+		"username": "ci",
+		"password": "ci-secret",
+	})
+
+	// The roles are only accepted from the path
+	if _, err := testHandle(b, s, logical.UpdateOperation, "creds-batch", map[string]interface{}{
+		"roles": "nexus",
+	}); err != logical.ErrUnsupportedPath {
+		t.Fatalf("expected an unsupported path, got %v", err)
+	}
+
+	// Basic roles have no lease
+	resp := testRequest(t, b, s, logical.ReadOperation, "creds-batch/nexus,nexus", nil)
+	if resp.Secret != nil {
+		t.Fatalf("unexpected lease for basic roles: %#v", resp.Secret)
+	}
+	if roles := resp.Data["roles"].(map[string]interface{}); len(roles) != 1 {
+		t.Fatalf("expected deduplicated roles, got %#v", roles)
+	}
+}
@@ -0,0 +1,194 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/zntrio/vault-plugin-secrets-docker-registry/scope"
+)
+
+const (
+	registryPath = "registry"
+)
+
+// pathRegistry defines the read-only registry browsing paths.
+func (b *backend) pathRegistry() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern:         registryPath + "/catalog",
+			HelpSynopsis:    `List the registry repositories.`,
+			HelpDescription: `This path lists the registry repositories visible with the mount credentials, using the /v2/_catalog endpoint.`,
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: withFieldValidator(b.pathRegistryCatalogRead),
+			},
+		},
+		{
+			Pattern:         registryPath + "/tags/(?P<repository>.+)",
+			HelpSynopsis:    `List the tags of a registry repository.`,
+			HelpDescription: `This path lists the tags of a registry repository visible with the mount credentials, using the /v2/<name>/tags/list endpoint.`,
+
+			Fields: map[string]*framework.FieldSchema{
+				"repository": {
+					Type:        framework.TypeString,
+					Description: "Name of the repository",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: withFieldValidator(b.pathRegistryTagsRead),
+			},
+		},
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+func (b *backend) pathRegistryCatalogRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	engine, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	client, err := b.Client(engine)
+	if err != nil {
+		return nil, err
+	}
+
+	repositories, err := b.catalog(ctx, engine, client)
+	if err != nil {
+		if coded := codedRegistryError(err); coded != err {
+			return nil, coded
+		}
+		return nil, errwrap.Wrapf("unable to list registry catalog: {{err}}", err)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"registry_url": engine.RegistryURL,
+			"repositories": repositories,
+		},
+	}, nil
+}
+
+func (b *backend) pathRegistryTagsRead(ctx context.Context, req *logical.Request, fieldData *framework.FieldData) (*logical.Response, error) {
+	repository := fieldData.Get("repository").(string)
+
+	// Validate repository name
+	repoScope, err := scope.Parse(fmt.Sprintf("repository:%s:pull", repository))
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	engine, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	client, err := b.Client(engine)
+	if err != nil {
+		return nil, err
+	}
+
+	authorization, err := b.registryAuthorization(ctx, engine, client, []string{repoScope.String()})
+	if err != nil {
+		if coded := codedRegistryError(err); coded != err {
+			return nil, coded
+		}
+		return nil, errwrap.Wrapf("unable to authorize registry request: {{err}}", err)
+	}
+
+	tags, err := client.Tags(ctx, engine.RegistryURL, authorization, repository)
+	if err != nil {
+		if coded := codedRegistryError(err); coded != err {
+			return nil, coded
+		}
+		return nil, errwrap.Wrapf("unable to list repository tags: {{err}}", err)
+	}
+	sort.Strings(tags)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"registry_url": engine.RegistryURL,
+			"repository":   repository,
+			"tags":         tags,
+		},
+	}, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// catalog lists the registry repositories with the mount credentials.
+func (b *backend) catalog(ctx context.Context, engine *Config, client RegistryClient) ([]string, error) {
+	authorization, err := b.registryAuthorization(ctx, engine, client, []string{"registry:catalog:*"})
+	if err != nil {
+		return nil, err
+	}
+
+	repositories, err := client.Catalog(ctx, engine.RegistryURL, authorization)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(repositories)
+
+	return repositories, nil
+}
+
+// registryAuthorization returns the Authorization header value used to call
+// the registry API with the mount credentials, according to the registry
+// challenge.
+func (b *backend) registryAuthorization(ctx context.Context, engine *Config, client RegistryClient, scopes []string) (string, error) {
+	challenge, err := client.Challenge(ctx, engine.RegistryURL)
+	if err != nil {
+		return "", err
+	}
+
+	switch challenge.Scheme {
+	case "":
+		// Anonymous access
+		return "", nil
+	case challengeSchemeBasic:
+		credentials := base64.StdEncoding.EncodeToString([]byte(engine.Username + ":" + engine.Password))
+		return "Basic " + credentials, nil
+	}
+
+	realm, service, err := b.resolveTokenService(ctx, client, engine, "")
+	if err != nil {
+		return "", err
+	}
+	tr, err := engine.TokenRequest(realm, service, scopes)
+	if err != nil {
+		return "", err
+	}
+
+	var t *RegistryToken
+	if err := retry(ctx, &engine.RetryPolicy, func() error {
+		var err error
+		t, err = client.Token(ctx, tr)
+		return err
+	}); err != nil {
+		return "", err
+	}
+
+	return "Bearer " + t.Token, nil
+}
@@ -19,10 +19,15 @@ package dockerregistry
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/zntrio/vault-plugin-secrets-docker-registry/scope"
 )
 
 const (
@@ -57,17 +62,93 @@ func (b *backend) pathRoles() []*framework.Path {
 					Type:        framework.TypeLowerCaseString,
 					Description: "Role name",
 				},
+				"type": {
+					Type:          framework.TypeString,
+					Description:   "Credential type: token issues registry tokens, basic returns static credentials for registries without token service",
+					Default:       roleTypeToken,
+					AllowedValues: []interface{}{roleTypeToken, roleTypeBasic},
+				},
 				"service": {
 					Type:        framework.TypeLowerCaseString,
-					Description: "Name of the service",
-					Default:     "registry.docker.io",
+					Description: "Name of the service, discovered from the registry when empty",
 				},
 				"scopes": {
 					Type:        framework.TypeStringSlice,
-					Description: "Request scopes",
+					Description: "Request scopes, following the type[(class)]:name:actions grammar (e.g. repository:samalba/my-app:pull,push). Repository names may be globs (team-a/*) or ~ prefixed regular expressions expanded from the registry catalog",
+				},
+				"registries": {
+					Type:        framework.TypeSlice,
+					Description: "List of {service, endpoint, scopes} objects issuing one token per registry endpoint, replacing service and scopes. Entries may hold their own token_flow, client_id, username, password, refresh_token, trusted_certificates, jwks and token_issuer, the engine ones are only used for the engine registry",
+				},
+				"partial_failure": {
+					Type:          framework.TypeString,
+					Description:   "Behavior of multi-registry roles when a token request fails: fail the request, or report the error per registry",
+					Default:       partialFailureFail,
+					AllowedValues: []interface{}{partialFailureFail, partialFailureReport},
+				},
+				"offline_token": {
+					Type:        framework.TypeBool,
+					Description: "Request a refresh token usable as a docker login identity token",
+				},
+				"scope_enforcement": {
+					Type:          framework.TypeString,
+					Description:   "Behavior when the registry grants less than the requested scopes: ignore, warn or strict",
+					Default:       scopeEnforcementIgnore,
+					AllowedValues: []interface{}{scopeEnforcementIgnore, scopeEnforcementWarn, scopeEnforcementStrict},
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Default lease TTL of issued credentials, capped by the registry token expiration",
+				},
+				"max_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Maximum lease TTL of issued credentials, capped by the registry token expiration",
+				},
+				"cache": {
+					Type:        framework.TypeBool,
+					Description: "Share the issued tokens between requests of the role while they remain valid long enough",
+				},
+				"cache_min_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Minimum remaining lifetime of a cached token to be served",
+					Default:     int(defaultCacheMinTTL.Seconds()),
+				},
+				"entity_quota": {
+					Type:        framework.TypeInt,
+					Description: "Maximum number of credentials issued to a single entity per entity_quota_period, unlimited when 0",
+				},
+				"entity_quota_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Window of the entity quota",
+					Default:     int(defaultEntityQuotaPeriod.Seconds()),
+				},
+				"role_quota": {
+					Type:        framework.TypeInt,
+					Description: "Maximum number of credentials issued by the role per role_quota_period, unlimited when 0",
+				},
+				"role_quota_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Window of the role quota",
+					Default:     int(defaultRoleQuotaPeriod.Seconds()),
+				},
+				"username": {
+					Type:        framework.TypeString,
+					Description: "Username returned by basic roles, defaults to the engine username",
+				},
+				"password": {
+					Type:        framework.TypeString,
+					Description: "Password returned by basic roles, defaults to the engine password",
+				},
+				"verify_repositories": {
+					Type:          framework.TypeString,
+					Description:   "Check the role repositories exist on the registry when the role is written: ignore, warn or strict (reject the role)",
+					Default:       scopeEnforcementIgnore,
+					AllowedValues: []interface{}{scopeEnforcementIgnore, scopeEnforcementWarn, scopeEnforcementStrict},
 				},
 			},
 
+			ExistenceCheck: b.pathRoleExistenceCheck,
+
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.CreateOperation: withFieldValidator(b.pathRoleWriteOperation),
 				logical.ReadOperation:   withFieldValidator(b.pathRoleReadOperation),
@@ -75,30 +156,95 @@ func (b *backend) pathRoles() []*framework.Path {
 				logical.DeleteOperation: withFieldValidator(b.pathRoleDeleteOperation),
 			},
 		},
+		{
+			Pattern:         rolesPath + "/" + framework.GenericNameRegex("name") + "/usage",
+			HelpSynopsis:    `Read a role quota usage.`,
+			HelpDescription: `This path returns the credentials issued by the role in the current quota windows, for the whole role and per entity.`,
+
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Role name",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: withFieldValidator(b.pathRoleUsageReadOperation),
+			},
+		},
 	}
 }
 
 // -----------------------------------------------------------------------------
 
+// Role parses and returns the role from the storage backend, nil is returned
+// when the role does not exist. Decoded roles are kept in the snapshot, each
+// caller gets its own copy.
 func (b *backend) Role(ctx context.Context, s logical.Storage, roleName string) (*Role, error) {
-	r := &Role{}
+	b.RLock()
+	cached, ok := b.roles[roleName]
+	gen := b.snapshotGen
+	b.RUnlock()
+	if ok {
+		return cached.clone(), nil
+	}
+
+	var r *Role
 
 	entry, err := s.Get(ctx, rolesPath+"/"+roleName)
 	if err != nil {
 		return nil, errwrap.Wrapf("failed to get role from storage: {{err}}", err)
 	}
-	if entry == nil || len(entry.Value) == 0 {
-		return r, nil
+	if entry != nil && len(entry.Value) > 0 {
+		r = &Role{}
+		if err := entry.DecodeJSON(r); err != nil {
+			return nil, errwrap.Wrapf("failed to decode configuration: {{err}}", err)
+		}
 	}
 
-	if err := entry.DecodeJSON(&r); err != nil {
-		return nil, errwrap.Wrapf("failed to decode configuration: {{err}}", err)
+	// Unknown roles are not kept, any name can be requested
+	if r == nil {
+		return nil, nil
+	}
+	// Keep the snapshot unless it changed meanwhile
+	b.Lock()
+	if b.snapshotGen == gen {
+		if b.roles == nil {
+			b.roles = map[string]*Role{}
+		}
+		b.roles[roleName] = r.clone()
 	}
+	b.Unlock()
+
 	return r, nil
 }
 
+// setRole replaces the role snapshot after a write, nil drops it.
+func (b *backend) setRole(roleName string, r *Role) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.snapshotGen++
+	delete(b.roles, roleName)
+	if r != nil {
+		if b.roles == nil {
+			b.roles = map[string]*Role{}
+		}
+		b.roles[roleName] = r.clone()
+	}
+}
+
 // -----------------------------------------------------------------------------
 
+// pathRoleExistenceCheck checks if the role exists.
+func (b *backend) pathRoleExistenceCheck(ctx context.Context, req *logical.Request, fieldData *framework.FieldData) (bool, error) {
+	role, err := b.Role(ctx, req.Storage, fieldData.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return role != nil, nil
+}
+
 // pathRoleList retruns the list of exiting roles for docker-registry secret engine.
 func (b *backend) pathRoleListOperation(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
 	entries, err := req.Storage.List(ctx, rolesPath+"/")
@@ -126,6 +272,27 @@ func (b *backend) pathRoleReadOperation(ctx context.Context, req *logical.Reques
 	}, nil
 }
 
+func (b *backend) pathRoleUsageReadOperation(ctx context.Context, req *logical.Request, fieldData *framework.FieldData) (*logical.Response, error) {
+	roleName := fieldData.Get("name").(string)
+
+	role, err := b.Role(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	usage, err := b.roleUsage(ctx, req.Storage, role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: usage,
+	}, nil
+}
+
 func (b *backend) pathRoleWriteOperation(ctx context.Context, req *logical.Request, fieldData *framework.FieldData) (*logical.Response, error) {
 	roleName := fieldData.Get("name").(string)
 
@@ -134,6 +301,14 @@ func (b *backend) pathRoleWriteOperation(ctx context.Context, req *logical.Reque
 	if err != nil {
 		return nil, err
 	}
+	if r == nil {
+		if req.Operation == logical.UpdateOperation {
+			return nil, logical.CodedError(http.StatusNotFound, fmt.Sprintf("role %q not found", roleName))
+		}
+		r = &Role{
+			Name: roleName,
+		}
+	}
 
 	// Update the configuration
 	changed, err := r.Update(fieldData)
@@ -141,6 +316,19 @@ func (b *backend) pathRoleWriteOperation(ctx context.Context, req *logical.Reque
 		return nil, logical.CodedError(400, err.Error())
 	}
 
+	// Check repositories
+	var warnings []string
+	if mode := fieldData.Get("verify_repositories").(string); mode != scopeEnforcementIgnore {
+		problems, err := b.verifyRoleRepositories(ctx, req.Storage, r)
+		if err != nil {
+			return nil, err
+		}
+		if len(problems) > 0 && mode == scopeEnforcementStrict {
+			return nil, logical.CodedError(400, fmt.Sprintf("role repositories verification failed: %s", strings.Join(problems, "; ")))
+		}
+		warnings = problems
+	}
+
 	// Only do the following if the role is different
 	if changed {
 		// Generate a new storage entry
@@ -153,6 +341,17 @@ func (b *backend) pathRoleWriteOperation(ctx context.Context, req *logical.Reque
 		if err := req.Storage.Put(ctx, entry); err != nil {
 			return nil, errwrap.Wrapf("failed to persist role to storage: {{err}}", err)
 		}
+
+		b.setRole(roleName, r)
+
+		// Drop tokens issued with the previous settings
+		b.tokenCache.dropRole(roleName)
+	}
+
+	if len(warnings) > 0 {
+		return &logical.Response{
+			Warnings: warnings,
+		}, nil
 	}
 
 	// No error
@@ -165,7 +364,86 @@ func (b *backend) pathRoleDeleteOperation(ctx context.Context, req *logical.Requ
 	if err := req.Storage.Delete(ctx, rolesPath+"/"+roleName); err != nil {
 		return nil, err
 	}
+	b.setRole(roleName, nil)
+	if err := b.deleteRoleQuotas(ctx, req.Storage, roleName); err != nil {
+		return nil, err
+	}
+	b.tokenCache.dropRole(roleName)
 
 	// No error
 	return nil, nil
 }
+
+// -----------------------------------------------------------------------------
+
+// verifyRoleRepositories probes each repository scope of the role on its
+// registry, and returns the missing or forbidden repositories.
+func (b *backend) verifyRoleRepositories(ctx context.Context, s logical.Storage, r *Role) ([]string, error) {
+	engine, err := b.Config(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	client, err := b.Client(engine)
+	if err != nil {
+		return nil, err
+	}
+
+	// Multi-registry roles are checked against each registry
+	if len(r.Registries) == 0 {
+		return b.verifyRepositories(ctx, engine, client, r.Scopes, "")
+	}
+	problems := []string{}
+	for i := range r.Registries {
+		target := engine.ForRegistry(&r.Registries[i])
+		registryProblems, err := b.verifyRepositories(ctx, target, client, r.Registries[i].Scopes, target.RegistryURL+": ")
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, registryProblems...)
+	}
+
+	return problems, nil
+}
+
+// verifyRepositories probes each repository scope on the engine registry, the
+// reported problems are prefixed by the given string.
+func (b *backend) verifyRepositories(ctx context.Context, engine *Config, client RegistryClient, scopes []string, prefix string) ([]string, error) {
+	parsed, err := scope.ParseList(scopes)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	problems := []string{}
+	for _, sc := range parsed {
+		if sc.Type != "repository" {
+			continue
+		}
+		if sc.IsPattern() {
+			// Patterns are expanded against the catalog at issuance
+			continue
+		}
+
+		authorization, err := b.registryAuthorization(ctx, engine, client, []string{fmt.Sprintf("repository:%s:pull", sc.Name)})
+		if err == nil {
+			err = client.ProbeRepository(ctx, engine.RegistryURL, authorization, sc.Name)
+		}
+		if err == nil {
+			continue
+		}
+
+		var re *RegistryError
+		if !errors.As(err, &re) {
+			return nil, errwrap.Wrapf(fmt.Sprintf("%sunable to verify repository %q: {{err}}", prefix, sc.Name), err)
+		}
+		switch re.StatusCode {
+		case http.StatusNotFound:
+			problems = append(problems, fmt.Sprintf("%srepository %q does not exist", prefix, sc.Name))
+		case http.StatusUnauthorized, http.StatusForbidden:
+			problems = append(problems, fmt.Sprintf("%srepository %q is not accessible: %v", prefix, sc.Name, re))
+		default:
+			return nil, codedRegistryError(err)
+		}
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,465 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	rotationStatusPath  = "rotation/status"
+	rotationPendingPath = "rotation/pending"
+)
+
+// RotationStatus is the stored result of the last root credential rotation.
+type RotationStatus struct {
+	LastRotation     time.Time `json:"last_rotation"`
+	NextRotation     time.Time `json:"next_rotation"`
+	LastError        string    `json:"last_error"`
+	LastErrorAt      time.Time `json:"last_error_at"`
+	ConsecutiveFails int       `json:"consecutive_failures"`
+	PendingSince     time.Time `json:"pending_since"`
+}
+
+// AsMap returns rotation status as map.
+func (rs *RotationStatus) AsMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"last_error":           rs.LastError,
+		"consecutive_failures": rs.ConsecutiveFails,
+		"pending_secret":       !rs.PendingSince.IsZero(),
+	}
+	if !rs.LastRotation.IsZero() {
+		m["last_rotation"] = rs.LastRotation.UTC()
+	}
+	if !rs.NextRotation.IsZero() {
+		m["next_rotation"] = rs.NextRotation.UTC()
+	}
+	if !rs.LastErrorAt.IsZero() {
+		m["last_error_at"] = rs.LastErrorAt.UTC()
+	}
+	if !rs.PendingSince.IsZero() {
+		m["pending_since"] = rs.PendingSince.UTC()
+	}
+	return m
+}
+
+// pendingSecret is a rotated secret which failed its verification. It is kept
+// out of the configuration until a later rotation verifies it.
+type pendingSecret struct {
+	RegistryURL string    `json:"registry_url"`
+	Username    string    `json:"username"`
+	Password    string    `json:"password"`
+	TokenID     string    `json:"token_id"`
+	RotatedAt   time.Time `json:"rotated_at"`
+}
+
+// matches returns whether the pending secret belongs to the configured
+// registry identity.
+func (ps *pendingSecret) matches(c *Config) bool {
+	return ps.RegistryURL == c.RegistryURL && ps.Username == c.Username
+}
+
+// pathRotateRoot defines the docker-registry/rotate-root path on the backend.
+func (b *backend) pathRotateRoot() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern:         "rotate-root",
+			HelpSynopsis:    "Rotate the mount registry credential",
+			HelpDescription: "Request a new secret for the configured registry identity from the rotation provider, verify it with a token request, then replace the stored password. Reading this path returns the last rotation status.",
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: withFieldValidator(b.pathRotateRootUpdate),
+				logical.ReadOperation:   withFieldValidator(b.pathRotateRootRead),
+			},
+		},
+	}
+}
+
+// pathRotateRootRead corresponds to READ docker-registry/rotate-root and is
+// used to read the last rotation status.
+func (b *backend) pathRotateRootRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	status, err := b.RotationStatus(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: status.AsMap(),
+	}, nil
+}
+
+// pathRotateRootUpdate corresponds to UPDATE docker-registry/rotate-root and
+// is used to rotate the registry credential.
+func (b *backend) pathRotateRootUpdate(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	status, err := b.rotateRoot(ctx, req.Storage)
+	if err != nil {
+		if coded := codedRegistryError(err); coded != err {
+			return nil, coded
+		}
+		return nil, errwrap.Wrapf("unable to rotate registry credential: {{err}}", err)
+	}
+
+	return &logical.Response{
+		Data: status.AsMap(),
+	}, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// RotationStatus returns the last rotation status from the storage backend.
+func (b *backend) RotationStatus(ctx context.Context, s logical.Storage) (*RotationStatus, error) {
+	status := &RotationStatus{}
+
+	entry, err := s.Get(ctx, rotationStatusPath)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to get rotation status from storage: {{err}}", err)
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return status, nil
+	}
+
+	if err := entry.DecodeJSON(status); err != nil {
+		return nil, errwrap.Wrapf("failed to decode rotation status: {{err}}", err)
+	}
+	return status, nil
+}
+
+func (b *backend) putRotationStatus(ctx context.Context, s logical.Storage, status *RotationStatus) error {
+	entry, err := logical.StorageEntryJSON(rotationStatusPath, status)
+	if err != nil {
+		return errwrap.Wrapf("failed to generate JSON rotation status: {{err}}", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("failed to persist rotation status to storage: {{err}}", err)
+	}
+	return nil
+}
+
+// pendingSecret returns the rotated secret awaiting verification, nil when
+// there is none.
+func (b *backend) pendingSecret(ctx context.Context, s logical.Storage) (*pendingSecret, error) {
+	entry, err := s.Get(ctx, rotationPendingPath)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to get pending secret from storage: {{err}}", err)
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil, nil
+	}
+
+	pending := &pendingSecret{}
+	if err := entry.DecodeJSON(pending); err != nil {
+		return nil, errwrap.Wrapf("failed to decode pending secret: {{err}}", err)
+	}
+	return pending, nil
+}
+
+func (b *backend) putPendingSecret(ctx context.Context, s logical.Storage, pending *pendingSecret) error {
+	entry, err := logical.StorageEntryJSON(rotationPendingPath, pending)
+	if err != nil {
+		return errwrap.Wrapf("failed to generate JSON pending secret: {{err}}", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("failed to persist pending secret to storage: {{err}}", err)
+	}
+	return nil
+}
+
+func (b *backend) deletePendingSecret(ctx context.Context, s logical.Storage) error {
+	if err := s.Delete(ctx, rotationPendingPath); err != nil {
+		return errwrap.Wrapf("failed to delete pending secret from storage: {{err}}", err)
+	}
+	return nil
+}
+
+// rotateRoot rotates the registry credential and records the outcome in the
+// rotation status.
+func (b *backend) rotateRoot(ctx context.Context, s logical.Storage) (*RotationStatus, error) {
+	b.rotationLock.Lock()
+	defer b.rotationLock.Unlock()
+
+	status, err := b.RotationStatus(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	engine, rotated, rotateErr := b.rotateRootSecret(ctx, s)
+
+	// Update status
+	now := time.Now()
+	if rotated {
+		status.LastRotation = now
+	}
+	if rotateErr != nil {
+		status.LastError = rotateErr.Error()
+		status.LastErrorAt = now
+		status.ConsecutiveFails++
+	} else {
+		status.LastError = ""
+		status.ConsecutiveFails = 0
+	}
+	if engine != nil && engine.RotationPeriod > 0 {
+		status.NextRotation = now.Add(engine.RotationPeriod)
+	}
+	pending, err := b.pendingSecret(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	status.PendingSince = time.Time{}
+	if pending != nil {
+		status.PendingSince = pending.RotatedAt
+	}
+	if err := b.putRotationStatus(ctx, s, status); err != nil {
+		return nil, err
+	}
+
+	return status, rotateErr
+}
+
+// rotateRootSecret requests a new secret, verifies it then persists it in
+// the configuration. The returned flag reports whether the stored secret was
+// replaced. A secret which fails its verification is never stored in the
+// configuration: it is discarded when the provider supports it, or kept
+// pending until a later rotation verifies it.
+func (b *backend) rotateRootSecret(ctx context.Context, s logical.Storage) (*Config, bool, error) {
+	engine, err := b.Config(ctx, s)
+	if err != nil {
+		return nil, false, err
+	}
+	if engine.RefreshToken != "" {
+		return engine, false, errors.New("rotation of refresh_token identities is not supported")
+	}
+
+	// The secret left by a previous rotation may replace the stored one
+	pending, err := b.pendingSecret(ctx, s)
+	if err != nil {
+		return engine, false, err
+	}
+	if pending != nil && pending.matches(engine) {
+		if err := b.verifyRotatedSecret(ctx, engine, pending.Password, pending.TokenID); err == nil {
+			updated, err := b.storeRotatedSecret(ctx, s, engine, pending.Password, pending.TokenID)
+			if err != nil {
+				return engine, false, err
+			}
+			return updated, true, b.deletePendingSecret(ctx, s)
+		}
+	}
+
+	httpClient, err := engine.TransportConfig.HTTPClient()
+	if err != nil {
+		return engine, false, err
+	}
+	rotator, err := newRootRotator(engine, httpClient)
+	if err != nil {
+		return engine, false, err
+	}
+
+	// Request a new secret
+	secret, err := rotator.Rotate(ctx, engine)
+	if err != nil {
+		return engine, false, err
+	}
+
+	// Check the new secret before replacing the stored one
+	if verifyErr := b.verifyRotatedSecret(ctx, engine, secret.Password, secret.TokenID); verifyErr != nil {
+		if secret.Rollback != nil {
+			if rbErr := secret.Rollback(ctx); rbErr != nil {
+				b.Logger().Warn("unable to discard rotated secret", "error", rbErr)
+			}
+			return engine, false, errwrap.Wrapf("rotated secret verification failed: {{err}}", verifyErr)
+		}
+
+		// The provider can't restore the previous secret, keep the new one
+		// aside for the next rotation.
+		if err := b.keepPendingSecret(ctx, s, engine, &pendingSecret{
+			RegistryURL: engine.RegistryURL,
+			Username:    engine.Username,
+			Password:    secret.Password,
+			TokenID:     secret.TokenID,
+			RotatedAt:   time.Now(),
+		}); err != nil {
+			return engine, false, err
+		}
+		return engine, false, errwrap.Wrapf("rotated secret verification failed, kept pending: {{err}}", verifyErr)
+	}
+
+	// Persist the new secret
+	updated, err := b.storeRotatedSecret(ctx, s, engine, secret.Password, secret.TokenID)
+	if err != nil {
+		if secret.Rollback != nil {
+			if rbErr := secret.Rollback(ctx); rbErr != nil {
+				b.Logger().Warn("unable to discard rotated secret", "error", rbErr)
+			}
+		}
+		return engine, false, err
+	}
+	if pending != nil {
+		if err := b.deletePendingSecret(ctx, s); err != nil {
+			return updated, true, err
+		}
+	}
+
+	// Release the previous secret
+	if secret.Commit != nil {
+		if err := secret.Commit(ctx); err != nil {
+			b.Logger().Warn("unable to release previous registry secret", "error", err)
+		}
+	}
+
+	return updated, true, nil
+}
+
+// verifyRotatedSecret checks the given secret in place of the configured one,
+// the check is retried with the retry policy.
+func (b *backend) verifyRotatedSecret(ctx context.Context, engine *Config, password, tokenID string) error {
+	candidate := engine.clone()
+	candidate.Password = password
+	if tokenID != "" {
+		candidate.DockerHubTokenID = tokenID
+	}
+
+	return retry(ctx, &candidate.RetryPolicy, func() error {
+		_, err := b.verifyCredentials(ctx, candidate)
+		return err
+	})
+}
+
+// errRotationConflict is returned when the configuration identity changed
+// while a rotation was in progress.
+var errRotationConflict = errors.New("registry credential changed during the rotation, rotated secret discarded")
+
+// storeRotatedSecret replaces the configured secret. The configuration is
+// read again under the config lock so that concurrent writes are kept, only
+// the secret fields are updated.
+func (b *backend) storeRotatedSecret(ctx context.Context, s logical.Storage, engine *Config, password, tokenID string) (*Config, error) {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	updated, err := b.Config(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if !sameCredential(updated, engine) {
+		return nil, errRotationConflict
+	}
+	updated.Password = password
+	if tokenID != "" {
+		updated.DockerHubTokenID = tokenID
+	}
+
+	entry, err := logical.StorageEntryJSON("config", updated)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to generate JSON configuration: {{err}}", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return nil, errwrap.Wrapf("failed to persist configuration to storage: {{err}}", err)
+	}
+	b.setConfig(updated)
+
+	// Cached tokens were issued to the previous secret
+	b.tokenCache.reset()
+
+	return updated, nil
+}
+
+// keepPendingSecret stores the pending secret unless the configured
+// credential changed since the rotation started.
+func (b *backend) keepPendingSecret(ctx context.Context, s logical.Storage, engine *Config, pending *pendingSecret) error {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	current, err := b.Config(ctx, s)
+	if err != nil {
+		return err
+	}
+	if !sameCredential(current, engine) {
+		return errRotationConflict
+	}
+
+	return b.putPendingSecret(ctx, s, pending)
+}
+
+// sameCredential returns whether both configurations hold the same registry
+// credential.
+func sameCredential(c, other *Config) bool {
+	return c.RegistryURL == other.RegistryURL && c.Username == other.Username && c.Password == other.Password &&
+		c.RotationProvider == other.RotationProvider
+}
+
+// verifyCredentials checks the configuration credentials with a token request
+// without scope, and returns the issued token.
+func (b *backend) verifyCredentials(ctx context.Context, engine *Config) (*RegistryToken, error) {
+	client, err := b.Client(engine)
+	if err != nil {
+		return nil, err
+	}
+
+	realm, service, err := b.resolveTokenService(ctx, client, engine, "")
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := engine.TokenRequest(realm, service, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := client.Token(ctx, tr)
+	if err != nil {
+		return nil, err
+	}
+	t.RegistryURL = engine.RegistryURL
+
+	return t, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// periodicRotateRoot rotates the registry credential when the rotation period
+// has elapsed.
+func (b *backend) periodicRotateRoot(ctx context.Context, s logical.Storage) error {
+	engine, err := b.Config(ctx, s)
+	if err != nil {
+		return err
+	}
+	if engine.RotationPeriod <= 0 || engine.RotationProvider == rotationProviderNone {
+		return nil
+	}
+
+	status, err := b.RotationStatus(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	// Schedule the first rotation
+	if status.NextRotation.IsZero() {
+		status.NextRotation = time.Now().Add(engine.RotationPeriod)
+		return b.putRotationStatus(ctx, s, status)
+	}
+	if time.Now().Before(status.NextRotation) {
+		return nil
+	}
+
+	_, err = b.rotateRoot(ctx, s)
+	return err
+}
@@ -0,0 +1,269 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	toolsPath = "tools"
+)
+
+// pathTools defines the diagnostic paths.
+func (b *backend) pathTools() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern:         toolsPath + "/introspect",
+			HelpSynopsis:    `Describe a registry token.`,
+			HelpDescription: `Decode a registry token and return its claims and access entries. The signature is verified when trusted material is configured, for the configured registry or the registry entry of a role. The roles of the mount requesting scopes covered by the token are listed.`,
+
+			Fields: map[string]*framework.FieldSchema{
+				"token": {
+					Type:        framework.TypeString,
+					Description: "Registry token to describe",
+				},
+				"role": {
+					Type:        framework.TypeString,
+					Description: "Role whose registry entry verifies the token",
+				},
+				"registry": {
+					Type:        framework.TypeString,
+					Description: "Registry which issued the token, the configured registry by default",
+				},
+			},
+
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: withFieldValidator(b.pathToolsIntrospectWrite),
+			},
+		},
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+func (b *backend) pathToolsIntrospectWrite(ctx context.Context, req *logical.Request, fieldData *framework.FieldData) (*logical.Response, error) {
+	raw := strings.TrimSpace(fieldData.Get("token").(string))
+	raw = strings.TrimSpace(strings.TrimPrefix(raw, "Bearer "))
+	if raw == "" {
+		return nil, errMissingFields("token")
+	}
+
+	registryURL, err := normalizeRegistryURL(fieldData.Get("registry").(string))
+	if err != nil {
+		return nil, logical.CodedError(http.StatusBadRequest, err.Error())
+	}
+
+	engine, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	target, err := b.introspectTarget(ctx, req.Storage, engine, fieldData.Get("role").(string), registryURL)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := target.TokenVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode the token, checking its signature when possible
+	claims, verified, err := verifier.decode(raw)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+	tc := claims.TokenClaims()
+
+	access := make([]map[string]interface{}, 0, len(claims.Access))
+	scopes := make([]string, 0, len(claims.Access))
+	for _, a := range claims.Access {
+		entry := map[string]interface{}{
+			"type":    a.Type,
+			"name":    a.Name,
+			"actions": a.Actions,
+		}
+		if a.Class != "" {
+			entry["class"] = a.Class
+		}
+		access = append(access, entry)
+		scopes = append(scopes, a.String())
+	}
+
+	// Roles requesting scopes covered by the token
+	matchingRoles, err := b.rolesCoveredBy(ctx, req.Storage, tc.Audience, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"issuer":             tc.Issuer,
+			"subject":            tc.Subject,
+			"audience":           tc.Audience,
+			"id":                 tc.ID,
+			"access":             access,
+			"signature_verified": verified,
+			"expired":            !tc.ExpiresAt.IsZero() && !time.Now().Before(tc.ExpiresAt),
+			"matching_roles":     matchingRoles,
+			"registry_url":       target.RegistryURL,
+		},
+	}
+	for k, v := range map[string]time.Time{"not_before": tc.NotBefore, "issued_at": tc.IssuedAt, "expires_at": tc.ExpiresAt} {
+		if !v.IsZero() {
+			resp.Data[k] = v.UTC()
+		}
+	}
+
+	if !verified {
+		resp.AddWarning("no trusted material configured, the token signature was not verified")
+	}
+	if target.TokenIssuer != "" && tc.Issuer != target.TokenIssuer {
+		resp.AddWarning(fmt.Sprintf("token issuer %q does not match the configured token_issuer %q", tc.Issuer, target.TokenIssuer))
+	}
+
+	return resp, nil
+}
+
+// introspectTarget returns the configuration whose trusted material verifies
+// an introspected token: the configured registry by default, or the registry
+// entry of the given role. A registry given without role must be declared
+// with the same trusted material by all roles targeting it.
+func (b *backend) introspectTarget(ctx context.Context, s logical.Storage, engine *Config, roleName, registryURL string) (*Config, error) {
+	if roleName == "" {
+		if registryURL == "" || registryURL == engine.RegistryURL {
+			return engine, nil
+		}
+		return b.introspectRegistryTarget(ctx, s, engine, registryURL)
+	}
+
+	role, err := b.Role(ctx, s, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, logical.CodedError(http.StatusNotFound, fmt.Sprintf("unknown role %q", roleName))
+	}
+
+	// Single registry role
+	if len(role.Registries) == 0 {
+		if registryURL != "" && registryURL != engine.RegistryURL {
+			return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("role %q does not target registry %q", roleName, registryURL))
+		}
+		return engine, nil
+	}
+
+	if registryURL == "" {
+		if len(role.Registries) > 1 {
+			return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("role %q declares several registries, set the registry", roleName))
+		}
+		return engine.ForRegistry(&role.Registries[0]), nil
+	}
+	rr := role.registry(registryURL, engine.RegistryURL)
+	if rr == nil {
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("role %q does not target registry %q", roleName, registryURL))
+	}
+	return engine.ForRegistry(rr), nil
+}
+
+// introspectRegistryTarget returns the configuration of a registry declared
+// by the role registry entries.
+func (b *backend) introspectRegistryTarget(ctx context.Context, s logical.Storage, engine *Config, registryURL string) (*Config, error) {
+	names, err := s.List(ctx, rolesPath+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var target *Config
+	var fingerprint, declaredBy string
+	for _, name := range names {
+		role, err := b.Role(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			continue
+		}
+		rr := role.registry(registryURL, engine.RegistryURL)
+		if rr == nil {
+			continue
+		}
+
+		candidate := engine.ForRegistry(rr)
+		verifier, err := candidate.TokenVerifier()
+		if err != nil {
+			return nil, err
+		}
+		if target == nil {
+			target, fingerprint, declaredBy = candidate, verifier.fingerprint(), name
+			continue
+		}
+		if verifier.fingerprint() != fingerprint {
+			return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("roles %q and %q declare different trusted material for registry %q, set the role", declaredBy, name, registryURL))
+		}
+	}
+	if target == nil {
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("no role targets registry %q", registryURL))
+	}
+
+	return target, nil
+}
+
+// rolesCoveredBy returns the token issuing roles whose requested scopes are all
+// granted by the given scopes, for one of the given audiences when the role
+// declares a service.
+func (b *backend) rolesCoveredBy(ctx context.Context, s logical.Storage, audience []string, granted []string) ([]string, error) {
+	names, err := s.List(ctx, rolesPath+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	matching := []string{}
+	for _, name := range names {
+		role, err := b.Role(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil || role.roleType() == roleTypeBasic {
+			continue
+		}
+
+		targets := role.Registries
+		if len(targets) == 0 {
+			targets = []RoleRegistry{{Service: role.Service, Scopes: role.Scopes}}
+		}
+		for _, t := range targets {
+			if len(t.Scopes) == 0 || (t.Service != "" && !strutil.StrListContains(audience, t.Service)) {
+				continue
+			}
+			if grantCovers(t.Scopes, granted) {
+				matching = append(matching, name)
+				break
+			}
+		}
+	}
+
+	return matching, nil
+}
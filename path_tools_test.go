@@ -0,0 +1,92 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/square/go-jose/v3/jwt"
+)
+
+func TestToolsIntrospectRegistryVerifier(t *testing.T) {
+	r := newTestRegistry(t)
+	b, s, _ := testBackend(t, r, nil)
+
+	testRequest(t, b, s, logical.CreateOperation, "roles/build", map[string]interface{}{
+		"registries": []interface{}{
+			map[string]interface{}{"scopes": []string{"repository:build/app:pull"}},
+			map[string]interface{}{
+				"endpoint":     "https://harbor.internal",
+				"scopes":       []string{"repository:build/app:pull"},
+				"token_issuer": "harbor-issuer",
+				"jwks":         testJWKS(t),
+			},
+		},
+	})
+
+	now := time.Now()
+	token := signTestToken(t, &jwtClaims{
+		Claims: jwt.Claims{
+			Issuer:   "harbor-issuer",
+			Audience: jwt.Audience{"harbor-registry"},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	})
+
+	testCases := []struct {
+		name         string
+		role         string
+		registry     string
+		wantCode     int
+		wantVerified bool
+	}{
+		{name: "configured registry"},
+		{name: "role registry", role: "build", registry: "harbor.internal", wantVerified: true},
+		{name: "registry without role", registry: "https://harbor.internal", wantVerified: true},
+		{name: "role without registry", role: "build", wantCode: http.StatusBadRequest},
+		{name: "undeclared registry", role: "build", registry: "https://other.internal", wantCode: http.StatusBadRequest},
+		{name: "unknown role", role: "missing", wantCode: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := testHandle(b, s, logical.UpdateOperation, "tools/introspect", map[string]interface{}{
+				"token":    token,
+				"role":     tc.role,
+				"registry": tc.registry,
+			})
+			if code := testErrorCode(resp, err); code != tc.wantCode {
+				t.Fatalf("expected status %d, got %d: %v", tc.wantCode, code, err)
+			}
+			if tc.wantCode != 0 {
+				return
+			}
+			if verified := resp.Data["signature_verified"].(bool); verified != tc.wantVerified {
+				t.Fatalf("expected signature_verified %v, got %v", tc.wantVerified, verified)
+			}
+			if tc.wantVerified && len(resp.Warnings) > 0 {
+				t.Fatalf("unexpected warnings: %v", resp.Warnings)
+			}
+		})
+	}
+}
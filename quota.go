@@ -0,0 +1,308 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	quotaPath = "quota"
+
+	defaultEntityQuotaPeriod = time.Hour
+	defaultRoleQuotaPeriod   = 24 * time.Hour
+)
+
+// QuotaCounter is the stored number of credentials issued in a fixed window.
+type QuotaCounter struct {
+	Subject     string    `json:"subject"`
+	Count       int       `json:"count"`
+	WindowStart time.Time `json:"window_start"`
+}
+
+// current returns the counter reset when its window has elapsed.
+func (qc *QuotaCounter) current(period time.Duration, now time.Time) *QuotaCounter {
+	if qc.WindowStart.IsZero() || !now.Before(qc.WindowStart.Add(period)) {
+		return &QuotaCounter{
+			Subject:     qc.Subject,
+			WindowStart: now,
+		}
+	}
+	return qc
+}
+
+// AsMap returns quota counter as map.
+func (qc *QuotaCounter) AsMap(limit int, period time.Duration) map[string]interface{} {
+	return map[string]interface{}{
+		"count":     qc.Count,
+		"limit":     limit,
+		"period":    int64(period.Seconds()),
+		"resets_at": qc.WindowStart.Add(period).UTC(),
+	}
+}
+
+// quotaSubject returns the identity quotas are counted for: the entity, or
+// the display name of tokens without entity.
+func quotaSubject(req *logical.Request) string {
+	if req.EntityID != "" {
+		return req.EntityID
+	}
+	return "display_name:" + req.DisplayName
+}
+
+// roleQuotaKey returns the storage key of the role counter.
+func roleQuotaKey(roleName string) string {
+	return fmt.Sprintf("%s/%s/role", quotaPath, roleName)
+}
+
+// entityQuotaKey returns the storage key of a subject counter, subjects are
+// hashed to get safe keys.
+func entityQuotaKey(roleName, subject string) string {
+	h := sha256.Sum256([]byte(subject))
+	return fmt.Sprintf("%s/%s/entity/%s", quotaPath, roleName, hex.EncodeToString(h[:]))
+}
+
+// -----------------------------------------------------------------------------
+
+// QuotaCounter returns the counter stored at the given key, an empty counter
+// is returned when it does not exist.
+func (b *backend) QuotaCounter(ctx context.Context, s logical.Storage, key string) (*QuotaCounter, error) {
+	counter := &QuotaCounter{}
+
+	entry, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to get quota counter from storage: {{err}}", err)
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return counter, nil
+	}
+
+	if err := entry.DecodeJSON(counter); err != nil {
+		return nil, errwrap.Wrapf("failed to decode quota counter: {{err}}", err)
+	}
+	return counter, nil
+}
+
+func (b *backend) putQuotaCounter(ctx context.Context, s logical.Storage, key string, counter *QuotaCounter) error {
+	entry, err := logical.StorageEntryJSON(key, counter)
+	if err != nil {
+		return errwrap.Wrapf("failed to generate JSON quota counter: {{err}}", err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("failed to persist quota counter to storage: {{err}}", err)
+	}
+	return nil
+}
+
+// quota is a role issuance limit.
+type quota struct {
+	key     string
+	subject string
+	name    string
+	limit   int
+	period  time.Duration
+}
+
+// roleQuotas returns the enabled quotas of the role for the request.
+func roleQuotas(req *logical.Request, role *Role) []quota {
+	quotas := []quota{}
+	if role.EntityQuota > 0 {
+		subject := quotaSubject(req)
+		quotas = append(quotas, quota{
+			key:     entityQuotaKey(role.Name, subject),
+			subject: subject,
+			name:    "entity",
+			limit:   role.EntityQuota,
+			period:  role.entityQuotaPeriod(),
+		})
+	}
+	if role.RoleQuota > 0 {
+		quotas = append(quotas, quota{
+			key:    roleQuotaKey(role.Name),
+			name:   "role",
+			limit:  role.RoleQuota,
+			period: role.roleQuotaPeriod(),
+		})
+	}
+	return quotas
+}
+
+// consumeQuotas counts one credential against the role quotas, and returns a
+// function giving it back when the credential could not be issued. A coded
+// error holding the reset time is returned when a quota is exhausted.
+func (b *backend) consumeQuotas(ctx context.Context, req *logical.Request, role *Role) (func(), error) {
+	quotas := roleQuotas(req, role)
+	if len(quotas) == 0 {
+		return func() {}, nil
+	}
+
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+
+	// Check all quotas before counting
+	now := time.Now()
+	counters := make([]*QuotaCounter, len(quotas))
+	for i, q := range quotas {
+		stored, err := b.QuotaCounter(ctx, req.Storage, q.key)
+		if err != nil {
+			return nil, err
+		}
+		stored.Subject = q.subject
+
+		counter := stored.current(q.period, now)
+		if counter.Count >= q.limit {
+			return nil, logical.CodedError(http.StatusTooManyRequests, fmt.Sprintf("role %q %s quota of %d credentials per %s exceeded, resets at %s", role.Name, q.name, q.limit, q.period, counter.WindowStart.Add(q.period).UTC().Format(time.RFC3339)))
+		}
+		counters[i] = counter
+	}
+
+	for i, q := range quotas {
+		counters[i].Count++
+		if err := b.putQuotaCounter(ctx, req.Storage, q.key, counters[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	release := func() {
+		b.quotaLock.Lock()
+		defer b.quotaLock.Unlock()
+
+		for _, q := range quotas {
+			counter, err := b.QuotaCounter(ctx, req.Storage, q.key)
+			if err == nil && counter.Count > 0 {
+				counter.Count--
+				err = b.putQuotaCounter(ctx, req.Storage, q.key, counter)
+			}
+			if err != nil {
+				b.Logger().Warn("unable to release quota", "role", role.Name, "quota", q.name, "error", err)
+			}
+		}
+	}
+
+	return release, nil
+}
+
+// roleUsage returns the current quota usage of the role.
+func (b *backend) roleUsage(ctx context.Context, s logical.Storage, role *Role) (map[string]interface{}, error) {
+	now := time.Now()
+	usage := map[string]interface{}{}
+
+	if role.RoleQuota > 0 {
+		counter, err := b.QuotaCounter(ctx, s, roleQuotaKey(role.Name))
+		if err != nil {
+			return nil, err
+		}
+		usage["role"] = counter.current(role.roleQuotaPeriod(), now).AsMap(role.RoleQuota, role.roleQuotaPeriod())
+	}
+
+	if role.EntityQuota > 0 {
+		prefix := fmt.Sprintf("%s/%s/entity/", quotaPath, role.Name)
+		keys, err := s.List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		entities := map[string]interface{}{}
+		for _, k := range keys {
+			counter, err := b.QuotaCounter(ctx, s, prefix+k)
+			if err != nil {
+				return nil, err
+			}
+			counter = counter.current(role.entityQuotaPeriod(), now)
+			if counter.Count == 0 {
+				continue
+			}
+			entities[counter.Subject] = counter.AsMap(role.EntityQuota, role.entityQuotaPeriod())
+		}
+		usage["entities"] = entities
+	}
+
+	return usage, nil
+}
+
+// periodicPruneQuotas removes the entity counters whose window has elapsed.
+func (b *backend) periodicPruneQuotas(ctx context.Context, s logical.Storage) error {
+	roleNames, err := s.List(ctx, quotaPath+"/")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, dir := range roleNames {
+		roleName := strings.TrimSuffix(dir, "/")
+		role, err := b.Role(ctx, s, roleName)
+		if err != nil {
+			return err
+		}
+		if role == nil {
+			if err := b.deleteRoleQuotas(ctx, s, roleName); err != nil {
+				return err
+			}
+			continue
+		}
+
+		prefix := fmt.Sprintf("%s/%s/entity/", quotaPath, roleName)
+		keys, err := s.List(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			b.quotaLock.Lock()
+			counter, err := b.QuotaCounter(ctx, s, prefix+k)
+			if err == nil && (role.EntityQuota == 0 || !now.Before(counter.WindowStart.Add(role.entityQuotaPeriod()))) {
+				err = s.Delete(ctx, prefix+k)
+			}
+			b.quotaLock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// deleteRoleQuotas removes the quota counters of the role.
+func (b *backend) deleteRoleQuotas(ctx context.Context, s logical.Storage, roleName string) error {
+	keys := []string{roleQuotaKey(roleName)}
+
+	prefix := fmt.Sprintf("%s/%s/entity/", quotaPath, roleName)
+	entities, err := s.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range entities {
+		keys = append(keys, prefix+k)
+	}
+
+	for _, k := range keys {
+		if err := s.Delete(ctx, k); err != nil {
+			return errwrap.Wrapf("failed to delete quota counter: {{err}}", err)
+		}
+	}
+	return nil
+}
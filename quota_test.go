@@ -0,0 +1,100 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestQuotaCounters(t *testing.T) {
+	r := newTestRegistry(t)
+	b, s, _ := testBackend(t, r, nil)
+
+	testRequest(t, b, s, logical.CreateOperation, "roles/push", map[string]interface{}{
+		"scopes":              []string{"repository:team-a/api:pull,push"},
+		"entity_quota":        2,
+		"entity_quota_period": "1h",
+		"role_quota":          10,
+		"role_quota_period":   "24h",
+	})
+
+	testRequest(t, b, s, logical.ReadOperation, "creds/push", nil)
+
+	// Failed issuances don't consume the quota
+	r.mu.Lock()
+	r.tokenFailures = []int{http.StatusBadRequest}
+	r.mu.Unlock()
+	resp, err := testHandle(b, s, logical.ReadOperation, "creds/push", nil)
+	if code := testErrorCode(resp, err); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d: %v", http.StatusBadRequest, code, err)
+	}
+
+	testRequest(t, b, s, logical.ReadOperation, "creds/push", nil)
+
+	// The entity quota is exhausted
+	resp, err = testHandle(b, s, logical.ReadOperation, "creds/push", nil)
+	if code := testErrorCode(resp, err); code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d: %v", http.StatusTooManyRequests, code, err)
+	}
+
+	usage := testRequest(t, b, s, logical.ReadOperation, "roles/push/usage", nil)
+	role := usage.Data["role"].(map[string]interface{})
+	if count := role["count"].(int); count != 2 {
+		t.Errorf("role quota count = %d, want 2", count)
+	}
+	entity := usage.Data["entities"].(map[string]interface{})["entity-1"].(map[string]interface{})
+	if count := entity["count"].(int); count != 2 {
+		t.Errorf("entity quota count = %d, want 2", count)
+	}
+	if resetsAt := entity["resets_at"].(time.Time); resetsAt.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("entity quota resets at %s, want about an hour from now", resetsAt)
+	}
+}
+
+func TestQuotaCounterWindow(t *testing.T) {
+	now := time.Now()
+	period := time.Hour
+
+	testCases := []struct {
+		name      string
+		counter   *QuotaCounter
+		wantCount int
+		wantReset bool
+	}{
+		{name: "new counter", counter: &QuotaCounter{}, wantReset: true},
+		{name: "current window", counter: &QuotaCounter{Count: 3, WindowStart: now.Add(-30 * time.Minute)}, wantCount: 3},
+		{name: "elapsed window", counter: &QuotaCounter{Count: 3, WindowStart: now.Add(-time.Hour)}, wantReset: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got := tc.counter.current(period, now)
+			if got.Count != tc.wantCount {
+				t.Errorf("count = %d, want %d", got.Count, tc.wantCount)
+			}
+			if reset := got.WindowStart.Equal(now); reset != tc.wantReset {
+				t.Errorf("window reset = %v, want %v", reset, tc.wantReset)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// rateLimitProbeRepository is the Docker Hub repository dedicated to
+	// rate limit checks, its manifest HEAD requests are not counted.
+	rateLimitProbeRepository = "ratelimitpreview/test"
+)
+
+// errUpstreamBudget is returned when the mount upstream request budget is
+// exhausted.
+var errUpstreamBudget = errors.New("mount upstream request budget exhausted")
+
+// RateLimitStatus is the upstream quota advertised by the registry
+// RateLimit-Limit and RateLimit-Remaining headers.
+type RateLimitStatus struct {
+	Limit      int
+	Remaining  int
+	Window     time.Duration
+	Source     string
+	ObservedAt time.Time
+}
+
+// AsMap returns rate limit status as map.
+func (rs *RateLimitStatus) AsMap() map[string]interface{} {
+	return map[string]interface{}{
+		"limit":       rs.Limit,
+		"remaining":   rs.Remaining,
+		"window":      int64(rs.Window.Seconds()),
+		"source":      rs.Source,
+		"observed_at": rs.ObservedAt.UTC(),
+	}
+}
+
+// parseRateLimitHeaders decodes the RateLimit headers of a response, nil is
+// returned when they are missing. Values follow the "<count>;w=<seconds>"
+// format.
+func parseRateLimitHeaders(h http.Header) *RateLimitStatus {
+	limit, window, ok := parseRateLimitValue(h.Get("RateLimit-Limit"))
+	if !ok {
+		return nil
+	}
+	remaining, _, ok := parseRateLimitValue(h.Get("RateLimit-Remaining"))
+	if !ok {
+		return nil
+	}
+
+	return &RateLimitStatus{
+		Limit:      limit,
+		Remaining:  remaining,
+		Window:     window,
+		Source:     h.Get("Docker-RateLimit-Source"),
+		ObservedAt: time.Now(),
+	}
+}
+
+func parseRateLimitValue(raw string) (int, time.Duration, bool) {
+	parts := strings.Split(raw, ";")
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var window time.Duration
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "w=") {
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(p, "w=")); err == nil {
+				window = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	return count, window, true
+}
+
+// rateLimitKey identifies the registry host of a URL, the path and the
+// default port are ignored.
+func rateLimitKey(u *url.URL) string {
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && !(scheme == "https" && port == "443") && !(scheme == "http" && port == "80") {
+		host = net.JoinHostPort(host, port)
+	}
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
+
+// -----------------------------------------------------------------------------
+
+// challengeCache is implemented by registry clients caching the registry
+// challenges.
+type challengeCache interface {
+	knownChallenge(registryURL string) *AuthChallenge
+}
+
+// budgetedClient consumes the mount upstream request budget before each
+// registry call, challenges served from the client cache are not counted.
+// Token revocations are exempt so that leases can always be revoked, and the
+// rotation provider requests don't go through the registry client.
+type budgetedClient struct {
+	RegistryClient
+	limiter func() *rate.Limiter
+}
+
+func (bc *budgetedClient) allow() error {
+	if l := bc.limiter(); l != nil && !l.Allow() {
+		return errUpstreamBudget
+	}
+	return nil
+}
+
+func (bc *budgetedClient) Challenge(ctx context.Context, registryURL string) (*AuthChallenge, error) {
+	if cache, ok := bc.RegistryClient.(challengeCache); ok {
+		if challenge := cache.knownChallenge(registryURL); challenge != nil {
+			return challenge, nil
+		}
+	}
+	if err := bc.allow(); err != nil {
+		return nil, err
+	}
+	return bc.RegistryClient.Challenge(ctx, registryURL)
+}
+
+func (bc *budgetedClient) Token(ctx context.Context, tr *TokenRequest) (*RegistryToken, error) {
+	if err := bc.allow(); err != nil {
+		return nil, err
+	}
+	return bc.RegistryClient.Token(ctx, tr)
+}
+
+func (bc *budgetedClient) Catalog(ctx context.Context, registryURL, authorization string) ([]string, error) {
+	if err := bc.allow(); err != nil {
+		return nil, err
+	}
+	return bc.RegistryClient.Catalog(ctx, registryURL, authorization)
+}
+
+func (bc *budgetedClient) Tags(ctx context.Context, registryURL, authorization, repository string) ([]string, error) {
+	if err := bc.allow(); err != nil {
+		return nil, err
+	}
+	return bc.RegistryClient.Tags(ctx, registryURL, authorization, repository)
+}
+
+func (bc *budgetedClient) ProbeRepository(ctx context.Context, registryURL, authorization, repository string) error {
+	if err := bc.allow(); err != nil {
+		return err
+	}
+	return bc.RegistryClient.ProbeRepository(ctx, registryURL, authorization, repository)
+}
+
+func (bc *budgetedClient) ProbeRateLimit(ctx context.Context, registryURL, authorization string) (*RateLimitStatus, error) {
+	if err := bc.allow(); err != nil {
+		return nil, err
+	}
+	return bc.RegistryClient.ProbeRateLimit(ctx, registryURL, authorization)
+}
+
+// Revoke calls the wrapped client revocation hook, when implemented.
+func (bc *budgetedClient) Revoke(ctx context.Context, rt *RegistryToken) error {
+	if revoker, ok := bc.RegistryClient.(TokenRevoker); ok {
+		return revoker.Revoke(ctx, rt)
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// upstreamLimiter returns the mount upstream request limiter, nil when the
+// budget is disabled.
+func (b *backend) upstreamLimiter() *rate.Limiter {
+	b.limiterLock.Lock()
+	defer b.limiterLock.Unlock()
+
+	return b.limiter
+}
+
+// updateUpstreamLimiter rebuilds the upstream request limiter when the
+// configured budget changes.
+func (b *backend) updateUpstreamLimiter(c *Config) {
+	b.limiterLock.Lock()
+	defer b.limiterLock.Unlock()
+
+	if c.UpstreamRateLimit <= 0 {
+		b.limiter = nil
+		return
+	}
+
+	limit := rate.Limit(float64(c.UpstreamRateLimit) / time.Minute.Seconds())
+	burst := c.upstreamBurst()
+	if b.limiter != nil && b.limiter.Limit() == limit && b.limiter.Burst() == burst {
+		return
+	}
+	b.limiter = rate.NewLimiter(limit, burst)
+}
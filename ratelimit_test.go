@@ -0,0 +1,95 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRateLimitKey(t *testing.T) {
+	testCases := []struct {
+		raw  string
+		want string
+	}{
+		{raw: "https://registry-1.docker.io", want: "https://registry-1.docker.io"},
+		{raw: "https://registry-1.docker.io/", want: "https://registry-1.docker.io"},
+		{raw: "https://Registry.Example.com:443/mirror", want: "https://registry.example.com"},
+		{raw: "http://registry.example.com:80", want: "http://registry.example.com"},
+		{raw: "https://registry.example.com:5000/v2/_catalog?n=100", want: "https://registry.example.com:5000"},
+	}
+
+	for _, tc := range testCases {
+		u, err := url.Parse(tc.raw)
+		if err != nil {
+			t.Fatalf("url.Parse(%q) error = %v", tc.raw, err)
+		}
+		if got := rateLimitKey(u); got != tc.want {
+			t.Errorf("rateLimitKey(%q) = %q, want %q", tc.raw, got, tc.want)
+		}
+	}
+}
+
+func TestParseRateLimitHeaders(t *testing.T) {
+	h := http.Header{}
+	if got := parseRateLimitHeaders(h); got != nil {
+		t.Errorf("parseRateLimitHeaders() = %#v, want nil without headers", got)
+	}
+
+	h.Set("RateLimit-Limit", "100;w=21600")
+	h.Set("RateLimit-Remaining", "76;w=21600")
+	h.Set("Docker-RateLimit-Source", "203.0.113.7")
+	got := parseRateLimitHeaders(h)
+	if got == nil || got.Limit != 100 || got.Remaining != 76 || got.Window != 6*time.Hour || got.Source != "203.0.113.7" {
+		t.Errorf("parseRateLimitHeaders() = %#v", got)
+	}
+
+	h.Set("RateLimit-Remaining", "invalid")
+	if got := parseRateLimitHeaders(h); got != nil {
+		t.Errorf("parseRateLimitHeaders() = %#v, want nil with an invalid remaining count", got)
+	}
+}
+
+func TestRegistryClientRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Limit", "100;w=21600")
+		w.Header().Set("RateLimit-Remaining", "99;w=21600")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	client := NewRegistryClient(srv.Client())
+	if got := client.RateLimit(srv.URL); got != nil {
+		t.Fatalf("RateLimit() = %#v before any request", got)
+	}
+
+	if _, err := client.ProbeRateLimit(context.Background(), srv.URL+"/mirror", ""); err != nil {
+		t.Fatalf("ProbeRateLimit() error = %v", err)
+	}
+
+	// Recorded statuses are found whatever the registry URL path
+	for _, registryURL := range []string{srv.URL, srv.URL + "/", srv.URL + "/mirror"} {
+		if got := client.RateLimit(registryURL); got == nil || got.Remaining != 99 {
+			t.Errorf("RateLimit(%q) = %#v, want the recorded status", registryURL, got)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+)
+
+const (
+	retryStrategyFibonacci   = "fibonacci"
+	retryStrategyExponential = "exponential"
+
+	defaultRetryMaxAttempts  = 5
+	defaultRetryBaseInterval = 100 * time.Millisecond
+	defaultRetryMaxInterval  = 5 * time.Second
+)
+
+// RetryPolicy holds the token request retry settings.
+type RetryPolicy struct {
+	MaxAttempts  int           `json:"retry_max_attempts"`
+	BaseInterval time.Duration `json:"retry_base_interval"`
+	MaxInterval  time.Duration `json:"retry_max_interval"`
+	Jitter       bool          `json:"retry_jitter"`
+	Strategy     string        `json:"retry_strategy"`
+}
+
+// DefaultRetryPolicy returns a retry policy with the default values.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  defaultRetryMaxAttempts,
+		BaseInterval: defaultRetryBaseInterval,
+		MaxInterval:  defaultRetryMaxInterval,
+		Jitter:       true,
+		Strategy:     retryStrategyFibonacci,
+	}
+}
+
+// Update updates the retry policy from the given field data.
+func (p *RetryPolicy) Update(d *framework.FieldData) (bool, error) {
+	if d == nil {
+		return false, nil
+	}
+
+	changed := false
+
+	if v, ok := d.GetOk("retry_max_attempts"); ok {
+		nv := v.(int)
+		if nv < 1 {
+			return false, fmt.Errorf("retry_max_attempts must be greater than 0")
+		}
+		if nv != p.MaxAttempts {
+			p.MaxAttempts = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("retry_base_interval"); ok {
+		nv, err := parseRetryInterval("retry_base_interval", v.(string))
+		if err != nil {
+			return false, err
+		}
+		if nv != p.BaseInterval {
+			p.BaseInterval = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("retry_max_interval"); ok {
+		nv, err := parseRetryInterval("retry_max_interval", v.(string))
+		if err != nil {
+			return false, err
+		}
+		if nv != p.MaxInterval {
+			p.MaxInterval = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("retry_jitter"); ok {
+		nv := v.(bool)
+		if nv != p.Jitter {
+			p.Jitter = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("retry_strategy"); ok {
+		nv := strings.TrimSpace(v.(string))
+		switch nv {
+		case retryStrategyFibonacci, retryStrategyExponential:
+		default:
+			return false, fmt.Errorf("retry_strategy %q is not supported, expected %q or %q", nv, retryStrategyFibonacci, retryStrategyExponential)
+		}
+		if nv != p.Strategy {
+			p.Strategy = nv
+			changed = true
+		}
+	}
+
+	if p.MaxInterval < p.BaseInterval {
+		return false, fmt.Errorf("retry_max_interval must be greater than or equal to retry_base_interval")
+	}
+
+	return changed, nil
+}
+
+// AsMap returns retry policy as map.
+func (p *RetryPolicy) AsMap() map[string]interface{} {
+	return map[string]interface{}{
+		"retry_max_attempts":  p.MaxAttempts,
+		"retry_base_interval": p.BaseInterval.String(),
+		"retry_max_interval":  p.MaxInterval.String(),
+		"retry_jitter":        p.Jitter,
+		"retry_strategy":      p.Strategy,
+	}
+}
+
+// delay returns the wait duration before the next attempt. It returns false
+// when the registry asks to wait longer than the maximum interval.
+func (p *RetryPolicy) delay(backoffDelay, retryAfter time.Duration) (time.Duration, bool) {
+	d := backoffDelay
+	if d > p.MaxInterval {
+		d = p.MaxInterval
+	}
+	if p.Jitter && d > 0 {
+		// Wait between half and the full delay
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+
+	// Honor registry hint
+	if retryAfter > 0 {
+		if retryAfter > p.MaxInterval {
+			return 0, false
+		}
+		if retryAfter > d {
+			d = retryAfter
+		}
+	}
+
+	return d, true
+}
+
+func parseRetryInterval(name, raw string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(raw))
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid duration: %v", name, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s must be positive", name)
+	}
+	return d, nil
+}
@@ -0,0 +1,167 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// testNetError is a transport timeout.
+type testNetError struct{}
+
+func (testNetError) Error() string   { return "i/o timeout" }
+func (testNetError) Timeout() bool   { return true }
+func (testNetError) Temporary() bool { return true }
+
+func TestIsTransientError(t *testing.T) {
+	testCases := []struct {
+		name           string
+		err            error
+		wantTransient  bool
+		wantRetryAfter time.Duration
+	}{
+		{name: "throttled", err: &RegistryError{StatusCode: http.StatusTooManyRequests, RetryAfter: 3 * time.Second}, wantTransient: true, wantRetryAfter: 3 * time.Second},
+		{name: "request timeout", err: &RegistryError{StatusCode: http.StatusRequestTimeout}, wantTransient: true},
+		{name: "server error", err: fmt.Errorf("wrapped: %w", &RegistryError{StatusCode: http.StatusServiceUnavailable}), wantTransient: true},
+		{name: "bad request", err: &RegistryError{StatusCode: http.StatusBadRequest}},
+		{name: "unauthorized", err: &RegistryError{StatusCode: http.StatusUnauthorized}},
+		{name: "network", err: &url.Error{Op: "Get", URL: "https://registry.example", Err: testNetError{}}, wantTransient: true},
+		{name: "canceled", err: fmt.Errorf("request: %w", context.Canceled)},
+		{name: "other", err: errors.New("unexpected")},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			transient, retryAfter := isTransientError(tc.err)
+			if transient != tc.wantTransient || retryAfter != tc.wantRetryAfter {
+				t.Errorf("isTransientError() = (%v, %s), want (%v, %s)", transient, retryAfter, tc.wantTransient, tc.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxInterval: 2 * time.Second}
+
+	testCases := []struct {
+		name       string
+		backoff    time.Duration
+		retryAfter time.Duration
+		want       time.Duration
+		wantOK     bool
+	}{
+		{name: "backoff", backoff: time.Second, want: time.Second, wantOK: true},
+		{name: "capped backoff", backoff: 10 * time.Second, want: 2 * time.Second, wantOK: true},
+		{name: "longer registry hint", backoff: 100 * time.Millisecond, retryAfter: time.Second, want: time.Second, wantOK: true},
+		{name: "shorter registry hint", backoff: time.Second, retryAfter: 100 * time.Millisecond, want: time.Second, wantOK: true},
+		{name: "hint above max interval", backoff: time.Second, retryAfter: 3 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := p.delay(tc.backoff, tc.retryAfter)
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("delay() = (%s, %v), want (%s, %v)", got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestTokenRequestRetry(t *testing.T) {
+	testCases := []struct {
+		name         string
+		failures     []int
+		retryAfter   string
+		config       map[string]interface{}
+		wantCode     int
+		wantRequests int
+		wantMinDelay time.Duration
+	}{
+		{
+			name:         "transient errors retried",
+			failures:     []int{http.StatusServiceUnavailable, http.StatusBadGateway},
+			wantRequests: 3,
+		},
+		{
+			name:         "client error not retried",
+			failures:     []int{http.StatusBadRequest},
+			wantCode:     http.StatusBadRequest,
+			wantRequests: 1,
+		},
+		{
+			name:         "attempts exhausted",
+			failures:     []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			config:       map[string]interface{}{"retry_max_attempts": 2},
+			wantCode:     http.StatusBadGateway,
+			wantRequests: 2,
+		},
+		{
+			name:         "registry hint honored",
+			failures:     []int{http.StatusTooManyRequests},
+			retryAfter:   "1",
+			config:       map[string]interface{}{"retry_max_interval": "2s"},
+			wantRequests: 2,
+			wantMinDelay: time.Second,
+		},
+		{
+			name:         "registry hint above max interval",
+			failures:     []int{http.StatusTooManyRequests},
+			retryAfter:   "1",
+			wantCode:     http.StatusTooManyRequests,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			b, s, _ := testBackend(t, r, tc.config)
+			testRequest(t, b, s, logical.CreateOperation, "roles/pull", map[string]interface{}{
+				"scopes": []string{"repository:team-a/api:pull"},
+			})
+
+			r.mu.Lock()
+			r.tokenFailures, r.retryAfter = tc.failures, tc.retryAfter
+			r.mu.Unlock()
+
+			start := time.Now()
+			resp, err := testHandle(b, s, logical.ReadOperation, "creds/pull", nil)
+			elapsed := time.Since(start)
+			if code := testErrorCode(resp, err); code != tc.wantCode {
+				t.Fatalf("expected status %d, got %d: %v", tc.wantCode, code, err)
+			}
+			if requests, _ := r.counters(); requests != tc.wantRequests {
+				t.Errorf("token requests = %d, want %d", requests, tc.wantRequests)
+			}
+			if elapsed < tc.wantMinDelay {
+				t.Errorf("retried after %s, want at least %s", elapsed, tc.wantMinDelay)
+			}
+		})
+	}
+}
@@ -18,16 +18,102 @@
 package dockerregistry
 
 import (
+	"encoding/json"
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/zntrio/vault-plugin-secrets-docker-registry/scope"
 )
 
+const (
+	roleTypeToken = "token"
+	roleTypeBasic = "basic"
+
+	partialFailureFail   = "fail"
+	partialFailureReport = "report"
+
+	defaultCacheMinTTL = 30 * time.Second
+)
+
+// RoleRegistry is a token request target of a multi-registry role. The
+// engine credentials and trusted material are only used for the engine
+// registry, other registries use their own or none.
+type RoleRegistry struct {
+	Service  string   `json:"service"`
+	Endpoint string   `json:"endpoint"`
+	Scopes   []string `json:"scopes"`
+
+	TokenFlow    string `json:"token_flow"`
+	ClientID     string `json:"client_id"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	RefreshToken string `json:"refresh_token"`
+
+	TrustedCertificates string `json:"trusted_certificates"`
+	JWKS                string `json:"jwks"`
+	TokenIssuer         string `json:"token_issuer"`
+}
+
+// hasCredentials returns true if the registry declares its own identity.
+func (rr *RoleRegistry) hasCredentials() bool {
+	return rr.Username != "" || rr.Password != "" || rr.RefreshToken != ""
+}
+
+// hasTrustedMaterial returns true if the registry declares its own token
+// verification settings.
+func (rr *RoleRegistry) hasTrustedMaterial() bool {
+	return rr.TrustedCertificates != "" || rr.JWKS != "" || rr.TokenIssuer != ""
+}
+
+// AsMap returns the registry settings as map, without secrets.
+func (rr *RoleRegistry) AsMap() map[string]interface{} {
+	return map[string]interface{}{
+		"service":              rr.Service,
+		"endpoint":             rr.Endpoint,
+		"scopes":               rr.Scopes,
+		"token_flow":           rr.TokenFlow,
+		"client_id":            rr.ClientID,
+		"username":             rr.Username,
+		"trusted_certificates": rr.TrustedCertificates,
+		"jwks":                 rr.JWKS,
+		"token_issuer":         rr.TokenIssuer,
+	}
+}
+
 // Role is the stored configuration for role.
 type Role struct {
-	Name    string   `json:"name"`
-	Service string   `json:"service"`
-	Scopes  []string `json:"scopes"`
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Service      string   `json:"service"`
+	Scopes       []string `json:"scopes"`
+	OfflineToken bool     `json:"offline_token"`
+
+	ScopeEnforcement string `json:"scope_enforcement"`
+
+	TTL    time.Duration `json:"ttl"`
+	MaxTTL time.Duration `json:"max_ttl"`
+
+	// Cache shares the issued tokens between requests while their remaining
+	// lifetime is above CacheMinTTL.
+	Cache       bool          `json:"cache"`
+	CacheMinTTL time.Duration `json:"cache_min_ttl"`
+
+	// Registries replace Service and Scopes to issue one token per registry.
+	Registries     []RoleRegistry `json:"registries"`
+	PartialFailure string         `json:"partial_failure"`
+
+	// EntityQuota and RoleQuota limit the credentials issued per requesting
+	// entity and for the whole role in each period.
+	EntityQuota       int           `json:"entity_quota"`
+	EntityQuotaPeriod time.Duration `json:"entity_quota_period"`
+	RoleQuota         int           `json:"role_quota"`
+	RoleQuotaPeriod   time.Duration `json:"role_quota_period"`
+
+	// Username and Password override the engine credentials of basic roles.
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 // Update updates the role from the given field data.
@@ -46,6 +132,19 @@ func (c *Role) Update(d *framework.FieldData) (bool, error) {
 		}
 	}
 
+	if v, ok := d.GetOk("type"); ok {
+		nv := strings.TrimSpace(v.(string))
+		switch nv {
+		case roleTypeToken, roleTypeBasic:
+		default:
+			return false, fmt.Errorf("type %q is not supported, expected %q or %q", nv, roleTypeToken, roleTypeBasic)
+		}
+		if nv != c.Type {
+			c.Type = nv
+			changed = true
+		}
+	}
+
 	if v, ok := d.GetOk("service"); ok {
 		nv := strings.TrimSpace(v.(string))
 		if nv != c.Service {
@@ -55,18 +154,375 @@ func (c *Role) Update(d *framework.FieldData) (bool, error) {
 	}
 
 	if v, ok := d.GetOk("scopes"); ok {
-		c.Scopes = v.([]string)
+		scopes, err := scope.ParseList(v.([]string))
+		if err != nil {
+			return false, err
+		}
+		c.Scopes = scope.Strings(scopes)
+		changed = true
+	}
+
+	if v, ok := d.GetOk("registries"); ok {
+		registries, err := parseRoleRegistries(v.([]interface{}))
+		if err != nil {
+			return false, err
+		}
+		c.Registries = registries
 		changed = true
 	}
 
+	if v, ok := d.GetOk("partial_failure"); ok {
+		nv := strings.TrimSpace(v.(string))
+		switch nv {
+		case partialFailureFail, partialFailureReport:
+		default:
+			return false, fmt.Errorf("partial_failure %q is not supported, expected %q or %q", nv, partialFailureFail, partialFailureReport)
+		}
+		if nv != c.PartialFailure {
+			c.PartialFailure = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("offline_token"); ok {
+		nv := v.(bool)
+		if nv != c.OfflineToken {
+			c.OfflineToken = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("scope_enforcement"); ok {
+		nv := strings.TrimSpace(v.(string))
+		switch nv {
+		case scopeEnforcementIgnore, scopeEnforcementWarn, scopeEnforcementStrict:
+		default:
+			return false, fmt.Errorf("scope_enforcement %q is not supported, expected %q, %q or %q", nv, scopeEnforcementIgnore, scopeEnforcementWarn, scopeEnforcementStrict)
+		}
+		if nv != c.ScopeEnforcement {
+			c.ScopeEnforcement = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("ttl"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv != c.TTL {
+			c.TTL = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("max_ttl"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv != c.MaxTTL {
+			c.MaxTTL = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("cache"); ok {
+		nv := v.(bool)
+		if nv != c.Cache {
+			c.Cache = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("cache_min_ttl"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv < 0 {
+			return false, fmt.Errorf("cache_min_ttl must be positive")
+		}
+		if nv != c.CacheMinTTL {
+			c.CacheMinTTL = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("entity_quota"); ok {
+		nv := v.(int)
+		if nv < 0 {
+			return false, fmt.Errorf("entity_quota must be positive")
+		}
+		if nv != c.EntityQuota {
+			c.EntityQuota = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("entity_quota_period"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv < 0 {
+			return false, fmt.Errorf("entity_quota_period must be positive")
+		}
+		if nv != c.EntityQuotaPeriod {
+			c.EntityQuotaPeriod = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("role_quota"); ok {
+		nv := v.(int)
+		if nv < 0 {
+			return false, fmt.Errorf("role_quota must be positive")
+		}
+		if nv != c.RoleQuota {
+			c.RoleQuota = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("role_quota_period"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv < 0 {
+			return false, fmt.Errorf("role_quota_period must be positive")
+		}
+		if nv != c.RoleQuotaPeriod {
+			c.RoleQuotaPeriod = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("username"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != c.Username {
+			c.Username = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("password"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != c.Password {
+			c.Password = nv
+			changed = true
+		}
+	}
+
+	if c.roleType() != roleTypeBasic && (c.Username != "" || c.Password != "") {
+		return false, fmt.Errorf("username and password are only supported by %q roles", roleTypeBasic)
+	}
+
+	if len(c.Registries) > 0 {
+		if c.roleType() == roleTypeBasic {
+			return false, fmt.Errorf("registries are not supported by %q roles", roleTypeBasic)
+		}
+		if c.Service != "" || len(c.Scopes) > 0 {
+			return false, fmt.Errorf("service and scopes can't be combined with registries, set them on each registry")
+		}
+	}
+
+	if c.MaxTTL > 0 && c.TTL > c.MaxTTL {
+		return false, fmt.Errorf("ttl must be lower than or equal to max_ttl")
+	}
+
 	return changed, nil
 }
 
+// clone returns a deep copy of the role.
+func (c *Role) clone() *Role {
+	r := *c
+	if c.Scopes != nil {
+		r.Scopes = append([]string{}, c.Scopes...)
+	}
+	if c.Registries != nil {
+		r.Registries = make([]RoleRegistry, len(c.Registries))
+		for i, rr := range c.Registries {
+			if rr.Scopes != nil {
+				rr.Scopes = append([]string{}, rr.Scopes...)
+			}
+			r.Registries[i] = rr
+		}
+	}
+	return &r
+}
+
 // AsMap returns role object as map.
 func (c *Role) AsMap() map[string]interface{} {
+	registries := make([]map[string]interface{}, 0, len(c.Registries))
+	for i := range c.Registries {
+		registries = append(registries, c.Registries[i].AsMap())
+	}
+
 	return map[string]interface{}{
-		"name":    c.Name,
-		"service": c.Service,
-		"scopes":  c.Scopes,
+		"name":                c.Name,
+		"type":                c.roleType(),
+		"service":             c.Service,
+		"scopes":              c.Scopes,
+		"registries":          registries,
+		"partial_failure":     c.partialFailure(),
+		"offline_token":       c.OfflineToken,
+		"scope_enforcement":   c.scopeEnforcement(),
+		"ttl":                 int64(c.TTL.Seconds()),
+		"max_ttl":             int64(c.MaxTTL.Seconds()),
+		"cache":               c.Cache,
+		"cache_min_ttl":       int64(c.cacheMinTTL().Seconds()),
+		"entity_quota":        c.EntityQuota,
+		"entity_quota_period": int64(c.entityQuotaPeriod().Seconds()),
+		"role_quota":          c.RoleQuota,
+		"role_quota_period":   int64(c.roleQuotaPeriod().Seconds()),
+		"username":            c.Username,
+	}
+}
+
+// roleType returns the role type, roles stored without one issue tokens.
+func (c *Role) roleType() string {
+	if c.Type == "" {
+		return roleTypeToken
+	}
+	return c.Type
+}
+
+// scopeEnforcement returns the scope enforcement mode, roles stored without
+// one ignore scope differences.
+func (c *Role) scopeEnforcement() string {
+	if c.ScopeEnforcement == "" {
+		return scopeEnforcementIgnore
+	}
+	return c.ScopeEnforcement
+}
+
+// registry returns the declared registry with the given endpoint, nil if none.
+// Entries without endpoint target the engine registry.
+func (c *Role) registry(endpoint, engineURL string) *RoleRegistry {
+	for i := range c.Registries {
+		ep := c.Registries[i].Endpoint
+		if ep == "" {
+			ep = engineURL
+		}
+		if ep == endpoint {
+			return &c.Registries[i]
+		}
+	}
+	return nil
+}
+
+// partialFailure returns the behavior of multi-registry roles when a token
+// request fails, roles stored without one fail the whole request.
+func (c *Role) partialFailure() string {
+	if c.PartialFailure == "" {
+		return partialFailureFail
+	}
+	return c.PartialFailure
+}
+
+// cacheMinTTL returns the minimum remaining lifetime of a cached token.
+func (c *Role) cacheMinTTL() time.Duration {
+	if c.CacheMinTTL == 0 {
+		return defaultCacheMinTTL
+	}
+	return c.CacheMinTTL
+}
+
+// entityQuotaPeriod returns the window of the entity quota.
+func (c *Role) entityQuotaPeriod() time.Duration {
+	if c.EntityQuotaPeriod == 0 {
+		return defaultEntityQuotaPeriod
+	}
+	return c.EntityQuotaPeriod
+}
+
+// roleQuotaPeriod returns the window of the role quota.
+func (c *Role) roleQuotaPeriod() time.Duration {
+	if c.RoleQuotaPeriod == 0 {
+		return defaultRoleQuotaPeriod
+	}
+	return c.RoleQuotaPeriod
+}
+
+// LeaseTTL returns the lease TTL and max TTL of a token expiring at the given
+// time. Role settings can only shorten the token lifetime.
+func (c *Role) LeaseTTL(expiresAt time.Time) (time.Duration, time.Duration) {
+	remaining := time.Until(expiresAt)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	ttl, maxTTL := remaining, remaining
+	if c.TTL > 0 && c.TTL < ttl {
+		ttl = c.TTL
+	}
+	if c.MaxTTL > 0 && c.MaxTTL < maxTTL {
+		maxTTL = c.MaxTTL
 	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	return ttl, maxTTL
+}
+
+// parseRoleRegistries decodes and validates the registries of a role. Each
+// item is either an object or a JSON document holding an object or a list of
+// objects.
+func parseRoleRegistries(raw []interface{}) ([]RoleRegistry, error) {
+	registries := []RoleRegistry{}
+	for _, item := range raw {
+		switch v := item.(type) {
+		case string:
+			var list []RoleRegistry
+			if err := json.Unmarshal([]byte(v), &list); err == nil {
+				registries = append(registries, list...)
+				continue
+			}
+			var rr RoleRegistry
+			if err := json.Unmarshal([]byte(v), &rr); err != nil {
+				return nil, fmt.Errorf("invalid registries entry: %v", err)
+			}
+			registries = append(registries, rr)
+		default:
+			body, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid registries entry: %v", err)
+			}
+			var rr RoleRegistry
+			if err := json.Unmarshal(body, &rr); err != nil {
+				return nil, fmt.Errorf("invalid registries entry: %v", err)
+			}
+			registries = append(registries, rr)
+		}
+	}
+
+	endpoints := map[string]bool{}
+	for i := range registries {
+		rr := &registries[i]
+
+		endpoint, err := normalizeRegistryURL(rr.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if endpoints[endpoint] {
+			return nil, fmt.Errorf("registry %q is defined more than once", rr.Endpoint)
+		}
+		endpoints[endpoint] = true
+		rr.Endpoint = endpoint
+
+		rr.Service = strings.ToLower(strings.TrimSpace(rr.Service))
+
+		// Credentials
+		rr.TokenFlow = strings.TrimSpace(rr.TokenFlow)
+		switch rr.TokenFlow {
+		case "", tokenFlowBasic, tokenFlowOAuth2:
+		default:
+			return nil, fmt.Errorf("registry %q: token_flow %q is not supported, expected %q or %q", rr.Endpoint, rr.TokenFlow, tokenFlowBasic, tokenFlowOAuth2)
+		}
+		if rr.TokenFlow == tokenFlowOAuth2 && rr.RefreshToken == "" && (rr.Username == "" || rr.Password == "") {
+			return nil, fmt.Errorf("registry %q: oauth2 token flow requires a refresh token or username and password", rr.Endpoint)
+		}
+		if rr.TokenFlow != tokenFlowOAuth2 && rr.RefreshToken != "" && rr.Password == "" {
+			return nil, fmt.Errorf("registry %q: refresh_token authentication requires the %q token_flow", rr.Endpoint, tokenFlowOAuth2)
+		}
+		if _, err := newTokenVerifier(rr.TrustedCertificates, rr.JWKS, rr.TokenIssuer); err != nil {
+			return nil, fmt.Errorf("registry %q: %v", rr.Endpoint, err)
+		}
+
+		scopes, err := scope.ParseList(rr.Scopes)
+		if err != nil {
+			return nil, err
+		}
+		rr.Scopes = scope.Strings(scopes)
+	}
+
+	return registries, nil
 }
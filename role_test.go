@@ -0,0 +1,67 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRoleSnapshotIsolation(t *testing.T) {
+	b := &backend{}
+	storage := &logical.InmemStorage{}
+	ctx := context.Background()
+
+	entry, err := logical.StorageEntryJSON(rolesPath+"/build", &Role{
+		Name:   "build",
+		Scopes: []string{"repository:team/app:pull"},
+		Registries: []RoleRegistry{
+			{Endpoint: "https://ghcr.io", Scopes: []string{"repository:team/app:pull"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// Edit the first copy in place, then read the snapshot again
+	for i := 0; i < 2; i++ {
+		r, err := b.Role(ctx, storage, "build")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Scopes[0] != "repository:team/app:pull" || r.Registries[0].Scopes[0] != "repository:team/app:pull" || r.Registries[0].Endpoint != "https://ghcr.io" {
+			t.Fatalf("Role() = %#v, snapshot was modified by a caller", r)
+		}
+		r.Scopes[0] = "repository:team/app:push"
+		r.Registries[0].Scopes[0] = "repository:team/app:push"
+		r.Registries[0].Endpoint = "https://evil.example.com"
+	}
+
+	// Unknown roles are not kept
+	if r, err := b.Role(ctx, storage, "missing"); err != nil || r != nil {
+		t.Fatalf("Role() = %#v, %v, want no role", r, err)
+	}
+	if _, ok := b.roles["missing"]; ok {
+		t.Error("unknown role kept in the snapshot")
+	}
+}
@@ -0,0 +1,349 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+)
+
+const (
+	rotationProviderNone      = ""
+	rotationProviderHarbor    = "harbor"
+	rotationProviderDockerHub = "dockerhub"
+	rotationProviderWebhook   = "webhook"
+
+	defaultDockerHubURL = "https://hub.docker.com"
+)
+
+// RotationConfig holds the mount registry credential rotation settings.
+type RotationConfig struct {
+	RotationProvider string        `json:"rotation_provider"`
+	RotationURL      string        `json:"rotation_url"`
+	RotationPeriod   time.Duration `json:"rotation_period"`
+	HarborRobotID    int           `json:"harbor_robot_id"`
+	DockerHubTokenID string        `json:"dockerhub_token_id"`
+}
+
+// Update updates the rotation settings from the given field data.
+func (rc *RotationConfig) Update(d *framework.FieldData) (bool, error) {
+	if d == nil {
+		return false, nil
+	}
+
+	changed := false
+
+	if v, ok := d.GetOk("rotation_provider"); ok {
+		nv := strings.TrimSpace(v.(string))
+		switch nv {
+		case rotationProviderNone, rotationProviderHarbor, rotationProviderDockerHub, rotationProviderWebhook:
+		default:
+			return false, fmt.Errorf("rotation_provider %q is not supported", nv)
+		}
+		if nv != rc.RotationProvider {
+			rc.RotationProvider = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("rotation_url"); ok {
+		nv := strings.TrimSuffix(strings.TrimSpace(v.(string)), "/")
+		if nv != rc.RotationURL {
+			rc.RotationURL = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("rotation_period"); ok {
+		nv := time.Duration(v.(int)) * time.Second
+		if nv != rc.RotationPeriod {
+			rc.RotationPeriod = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("harbor_robot_id"); ok {
+		nv := v.(int)
+		if nv != rc.HarborRobotID {
+			rc.HarborRobotID = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("dockerhub_token_id"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != rc.DockerHubTokenID {
+			rc.DockerHubTokenID = nv
+			changed = true
+		}
+	}
+
+	// Validate provider settings
+	switch rc.RotationProvider {
+	case rotationProviderHarbor:
+		if rc.HarborRobotID <= 0 {
+			return false, errors.New("harbor_robot_id is required by the harbor rotation provider")
+		}
+	case rotationProviderWebhook:
+		if rc.RotationURL == "" {
+			return false, errors.New("rotation_url is required by the webhook rotation provider")
+		}
+	}
+	if rc.RotationPeriod > 0 && rc.RotationProvider == rotationProviderNone {
+		return false, errors.New("rotation_period requires a rotation_provider")
+	}
+
+	return changed, nil
+}
+
+// AsMap returns rotation settings as map.
+func (rc *RotationConfig) AsMap() map[string]interface{} {
+	return map[string]interface{}{
+		"rotation_provider":  rc.RotationProvider,
+		"rotation_url":       rc.RotationURL,
+		"rotation_period":    int64(rc.RotationPeriod.Seconds()),
+		"harbor_robot_id":    rc.HarborRobotID,
+		"dockerhub_token_id": rc.DockerHubTokenID,
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// RotatedSecret represents a new registry secret issued by a rotation
+// provider.
+type RotatedSecret struct {
+	Password string
+	TokenID  string
+
+	// Commit is called once the new secret is persisted, Rollback when it
+	// is discarded. Both are optional.
+	Commit   func(ctx context.Context) error
+	Rollback func(ctx context.Context) error
+}
+
+// RootRotator requests a new secret for the mount registry credential.
+type RootRotator interface {
+	Rotate(ctx context.Context, c *Config) (*RotatedSecret, error)
+}
+
+// newRootRotator returns the rotator matching the configured provider.
+func newRootRotator(c *Config, httpClient *http.Client) (RootRotator, error) {
+	switch c.RotationProvider {
+	case rotationProviderHarbor:
+		return &harborRotator{httpClient: httpClient}, nil
+	case rotationProviderDockerHub:
+		return &dockerHubRotator{httpClient: httpClient}, nil
+	case rotationProviderWebhook:
+		return &webhookRotator{httpClient: httpClient}, nil
+	default:
+		return nil, errors.New("no rotation_provider configured")
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// harborRotator refreshes a Harbor robot account secret.
+type harborRotator struct {
+	httpClient *http.Client
+}
+
+func (r *harborRotator) Rotate(ctx context.Context, c *Config) (*RotatedSecret, error) {
+	baseURL := c.RotationURL
+	if baseURL == "" {
+		baseURL = c.RegistryURL
+	}
+
+	// An empty secret lets Harbor generate a new one
+	var out struct {
+		Secret string `json:"secret"`
+	}
+	if err := doJSON(ctx, r.httpClient, http.MethodPatch, fmt.Sprintf("%s/api/v2.0/robots/%d", baseURL, c.HarborRobotID), func(req *http.Request) {
+		req.SetBasicAuth(c.Username, c.Password)
+	}, map[string]string{"secret": ""}, &out); err != nil {
+		return nil, fmt.Errorf("unable to refresh harbor robot secret: %w", err)
+	}
+	if out.Secret == "" {
+		return nil, errors.New("harbor did not return a robot secret")
+	}
+
+	return &RotatedSecret{
+		Password: out.Secret,
+	}, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// dockerHubRotator creates a new Docker Hub personal access token and deletes
+// the previous one once the new token is persisted.
+type dockerHubRotator struct {
+	httpClient *http.Client
+}
+
+func (r *dockerHubRotator) Rotate(ctx context.Context, c *Config) (*RotatedSecret, error) {
+	baseURL := c.RotationURL
+	if baseURL == "" {
+		baseURL = defaultDockerHubURL
+	}
+
+	// Authenticate
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := doJSON(ctx, r.httpClient, http.MethodPost, baseURL+"/v2/users/login", nil, map[string]string{
+		"username": c.Username,
+		"password": c.Password,
+	}, &login); err != nil {
+		return nil, fmt.Errorf("unable to login to docker hub: %w", err)
+	}
+	withBearer := func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+login.Token)
+	}
+
+	// Keep the scopes of the current token
+	scopes := []string{"repo:read"}
+	if c.DockerHubTokenID != "" {
+		var current struct {
+			Scopes []string `json:"scopes"`
+		}
+		if err := doJSON(ctx, r.httpClient, http.MethodGet, fmt.Sprintf("%s/v2/access-tokens/%s", baseURL, c.DockerHubTokenID), withBearer, nil, &current); err != nil {
+			return nil, fmt.Errorf("unable to read current docker hub access token: %w", err)
+		}
+		if len(current.Scopes) > 0 {
+			scopes = current.Scopes
+		}
+	}
+
+	// Create the new token
+	var created struct {
+		UUID  string `json:"uuid"`
+		Token string `json:"token"`
+	}
+	if err := doJSON(ctx, r.httpClient, http.MethodPost, baseURL+"/v2/access-tokens", withBearer, map[string]interface{}{
+		"token_label": fmt.Sprintf("vault-%s", time.Now().UTC().Format("20060102T150405Z")),
+		"scopes":      scopes,
+	}, &created); err != nil {
+		return nil, fmt.Errorf("unable to create docker hub access token: %w", err)
+	}
+	if created.Token == "" || created.UUID == "" {
+		return nil, errors.New("docker hub did not return an access token")
+	}
+
+	deleteToken := func(id string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			if id == "" {
+				return nil
+			}
+			return doJSON(ctx, r.httpClient, http.MethodDelete, fmt.Sprintf("%s/v2/access-tokens/%s", baseURL, id), withBearer, nil, nil)
+		}
+	}
+
+	return &RotatedSecret{
+		Password: created.Token,
+		TokenID:  created.UUID,
+		Commit:   deleteToken(c.DockerHubTokenID),
+		Rollback: deleteToken(created.UUID),
+	}, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// webhookRotator delegates the secret rotation to an external service. The
+// service receives the current identity and returns the new password.
+type webhookRotator struct {
+	httpClient *http.Client
+}
+
+func (r *webhookRotator) Rotate(ctx context.Context, c *Config) (*RotatedSecret, error) {
+	var out struct {
+		Password string `json:"password"`
+		TokenID  string `json:"token_id"`
+	}
+	if err := doJSON(ctx, r.httpClient, http.MethodPost, c.RotationURL, func(req *http.Request) {
+		req.SetBasicAuth(c.Username, c.Password)
+	}, map[string]string{
+		"registry_url": c.RegistryURL,
+		"username":     c.Username,
+	}, &out); err != nil {
+		return nil, fmt.Errorf("unable to call rotation webhook: %w", err)
+	}
+	if out.Password == "" {
+		return nil, errors.New("rotation webhook did not return a password")
+	}
+
+	return &RotatedSecret{
+		Password: out.Password,
+		TokenID:  out.TokenID,
+	}, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// doJSON sends a JSON request and decodes the JSON response into out, when
+// not nil.
+func doJSON(ctx context.Context, httpClient *http.Client, method, url string, prepare func(*http.Request), in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	// Prepare context
+	rctx, rcancel := context.WithTimeout(ctx, 30*time.Second)
+	defer rcancel()
+
+	// Prepare request
+	req, err := http.NewRequestWithContext(rctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if prepare != nil {
+		prepare(req)
+	}
+
+	// Do the request
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newRegistryError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
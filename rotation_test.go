@@ -0,0 +1,209 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// testWebhook is a rotation webhook returning a new password per call.
+type testWebhook struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	calls int
+	// during is called while the rotation is in progress, when set.
+	during func()
+}
+
+func newTestWebhook(t *testing.T) *testWebhook {
+	t.Helper()
+
+	wh := &testWebhook{}
+	wh.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		wh.mu.Lock()
+		wh.calls++
+		password, during := fmt.Sprintf("rotated-secret-%d", wh.calls), wh.during
+		wh.mu.Unlock()
+		if during != nil {
+			during()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"password": password})
+	}))
+	t.Cleanup(wh.Close)
+
+	return wh
+}
+
+func (wh *testWebhook) callCount() int {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	return wh.calls
+}
+
+func TestRotateRootPendingSecret(t *testing.T) {
+	r := newTestRegistry(t)
+	wh := newTestWebhook(t)
+	b, s, _ := testBackend(t, r, map[string]interface{}{
+		"rotation_provider": rotationProviderWebhook,
+		"rotation_url":      wh.URL,
+	})
+	ctx := context.Background()
+
+	// The registry rejects the new secret
+	r.mu.Lock()
+	r.tokenFailures = []int{http.StatusUnauthorized}
+	r.mu.Unlock()
+
+	if _, err := testHandle(b, s, logical.UpdateOperation, "rotate-root", nil); err == nil {
+		t.Fatal("expected rotation to fail verification")
+	}
+
+	engine, err := b.Config(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if engine.Password != "mount-secret" {
+		t.Fatalf("unverified secret was stored: %q", engine.Password)
+	}
+	status := testRequest(t, b, s, logical.ReadOperation, "rotate-root", nil)
+	if pending, _ := status.Data["pending_secret"].(bool); !pending {
+		t.Fatalf("expected pending secret in status: %v", status.Data)
+	}
+
+	// The next rotation activates the pending secret without a new request
+	status = testRequest(t, b, s, logical.UpdateOperation, "rotate-root", nil)
+	if pending, _ := status.Data["pending_secret"].(bool); pending {
+		t.Fatalf("pending secret still reported: %v", status.Data)
+	}
+	if got := wh.callCount(); got != 1 {
+		t.Fatalf("expected 1 webhook call, got %d", got)
+	}
+	engine, err = b.Config(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if engine.Password != "rotated-secret-1" {
+		t.Fatalf("pending secret not activated: %q", engine.Password)
+	}
+	pending, err := b.pendingSecret(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != nil {
+		t.Fatal("pending secret not deleted")
+	}
+}
+
+func TestConfigWriteDropsPendingSecret(t *testing.T) {
+	r := newTestRegistry(t)
+	b, s, _ := testBackend(t, r, nil)
+	ctx := context.Background()
+
+	if err := b.putPendingSecret(ctx, s, &pendingSecret{
+		RegistryURL: r.URL,
+		Username:    "mount",
+		Password:    "rotated-secret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unrelated settings keep it
+	testRequest(t, b, s, logical.UpdateOperation, "config", map[string]interface{}{
+		"health_check_interval": "2h",
+	})
+	if pending, err := b.pendingSecret(ctx, s); err != nil || pending == nil {
+		t.Fatalf("pending secret dropped by unrelated write: %v", err)
+	}
+
+	// A new credential drops it
+	testRequest(t, b, s, logical.UpdateOperation, "config", map[string]interface{}{
+		"password": "operator-secret",
+	})
+	if pending, err := b.pendingSecret(ctx, s); err != nil || pending != nil {
+		t.Fatalf("pending secret kept after credential change: %v", err)
+	}
+}
+
+func TestRotateRootConcurrentConfigWrite(t *testing.T) {
+	testCases := []struct {
+		name         string
+		write        map[string]interface{}
+		wantErr      bool
+		wantPassword string
+	}{
+		{
+			name:         "unrelated setting kept",
+			write:        map[string]interface{}{"health_check_interval": "2h"},
+			wantPassword: "rotated-secret-1",
+		},
+		{
+			name:         "replaced credential wins",
+			write:        map[string]interface{}{"password": "operator-secret", "health_check_interval": "2h"},
+			wantErr:      true,
+			wantPassword: "operator-secret",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			wh := newTestWebhook(t)
+			b, s, _ := testBackend(t, r, map[string]interface{}{
+				"rotation_provider": rotationProviderWebhook,
+				"rotation_url":      wh.URL,
+			})
+
+			var writeErr error
+			wh.during = func() {
+				_, writeErr = testHandle(b, s, logical.UpdateOperation, "config", tc.write)
+			}
+
+			_, err := testHandle(b, s, logical.UpdateOperation, "rotate-root", nil)
+			if writeErr != nil {
+				t.Fatal(writeErr)
+			}
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("unexpected rotation error: %v", err)
+			}
+
+			engine, err := b.Config(context.Background(), s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if engine.Password != tc.wantPassword {
+				t.Fatalf("expected password %q, got %q", tc.wantPassword, engine.Password)
+			}
+			if engine.HealthCheckInterval != 2*time.Hour {
+				t.Fatalf("concurrent config write lost: %v", engine.HealthCheckInterval)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package scope parses and normalizes docker distribution token scopes.
+//
+// The grammar is defined by the distribution token authentication
+// specification:
+//
+//	scope            := resourcescope [ ' ' resourcescope ]*
+//	resourcescope    := resourcetype ":" resourcename ":" action [ ',' action ]*
+//	resourcetype     := resourcetypevalue [ '(' resourcetypevalue ')' ]
+//	resourcename     := [ hostname '/' ] component [ '/' component ]*
+//	action           := /[a-z]*/ | '*'
+//
+// Repository names may also be patterns, expanded against the registry
+// catalog: a glob (team-a/*) or a regular expression prefixed by '~'
+// (~^team-a/(api|web)$).
+package scope
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// Wildcard is the action granting all actions on a resource.
+	Wildcard = "*"
+	// RegexpPrefix marks a repository name as a regular expression.
+	RegexpPrefix = "~"
+)
+
+var (
+	typeRegexp      = regexp.MustCompile(`^([a-z0-9]+)(?:\(([a-z0-9]+)\))?$`)
+	actionRegexp    = regexp.MustCompile(`^[a-z]*$`)
+	hostnameRegexp  = regexp.MustCompile(`^(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?$`)
+	componentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[_.]|__|[-]*)[a-z0-9]+)*$`)
+)
+
+// Scope represents a single resource scope.
+type Scope struct {
+	Type    string
+	Class   string
+	Name    string
+	Actions []string
+}
+
+// Parse decodes and validates a single resource scope.
+func Parse(s string) (*Scope, error) {
+	s = strings.TrimSpace(s)
+
+	// Resource names may contain a registry port, type is before the first
+	// colon and actions after the last one.
+	first, last := strings.Index(s, ":"), strings.LastIndex(s, ":")
+	if first < 0 || first == last {
+		return nil, fmt.Errorf("invalid scope %q: expected type:name:actions", s)
+	}
+
+	// Resource type
+	m := typeRegexp.FindStringSubmatch(s[:first])
+	if m == nil {
+		return nil, fmt.Errorf("invalid scope %q: invalid resource type %q", s, s[:first])
+	}
+
+	// Resource name
+	name := s[first+1 : last]
+	if isPattern(name) {
+		if m[1] != "repository" {
+			return nil, fmt.Errorf("invalid scope %q: name patterns are only supported by repository scopes", s)
+		}
+		if _, err := compilePattern(name); err != nil {
+			return nil, fmt.Errorf("invalid scope %q: %v", s, err)
+		}
+	} else if err := validateName(name); err != nil {
+		return nil, fmt.Errorf("invalid scope %q: %v", s, err)
+	}
+
+	// Actions
+	actions := []string{}
+	for _, a := range strings.Split(s[last+1:], ",") {
+		a = strings.TrimSpace(a)
+		if a != Wildcard && !actionRegexp.MatchString(a) {
+			return nil, fmt.Errorf("invalid scope %q: invalid action %q", s, a)
+		}
+		if a != "" {
+			actions = append(actions, a)
+		}
+	}
+	if len(actions) == 0 {
+		return nil, fmt.Errorf("invalid scope %q: no action", s)
+	}
+
+	return &Scope{
+		Type:    m[1],
+		Class:   m[2],
+		Name:    name,
+		Actions: normalizeActions(actions),
+	}, nil
+}
+
+// ParseList decodes, validates and normalizes a list of scopes. Each entry
+// may hold several space separated scopes.
+func ParseList(list []string) ([]*Scope, error) {
+	scopes := []*Scope{}
+	for _, entry := range list {
+		for _, raw := range strings.Fields(entry) {
+			s, err := Parse(raw)
+			if err != nil {
+				return nil, err
+			}
+			scopes = append(scopes, s)
+		}
+	}
+
+	return Normalize(scopes), nil
+}
+
+// Normalize merges scopes targeting the same resource, deduplicates and sorts
+// their actions, and sorts the result by resource.
+func Normalize(scopes []*Scope) []*Scope {
+	byResource := map[string]*Scope{}
+	for _, s := range scopes {
+		key := s.Resource()
+		if existing, ok := byResource[key]; ok {
+			existing.Actions = normalizeActions(append(existing.Actions, s.Actions...))
+			continue
+		}
+		byResource[key] = &Scope{
+			Type:    s.Type,
+			Class:   s.Class,
+			Name:    s.Name,
+			Actions: normalizeActions(append([]string{}, s.Actions...)),
+		}
+	}
+
+	out := make([]*Scope, 0, len(byResource))
+	for _, s := range byResource {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Resource() < out[j].Resource()
+	})
+
+	return out
+}
+
+// Strings returns the string representation of each scope.
+func Strings(scopes []*Scope) []string {
+	out := make([]string, 0, len(scopes))
+	for _, s := range scopes {
+		out = append(out, s.String())
+	}
+	return out
+}
+
+// Resource returns the scope resource identifier: type[(class)]:name.
+func (s *Scope) Resource() string {
+	if s.Class != "" {
+		return fmt.Sprintf("%s(%s):%s", s.Type, s.Class, s.Name)
+	}
+	return fmt.Sprintf("%s:%s", s.Type, s.Name)
+}
+
+// String returns the scope representation.
+func (s *Scope) String() string {
+	return fmt.Sprintf("%s:%s", s.Resource(), strings.Join(s.Actions, ","))
+}
+
+// HasAction returns true if the scope allows the given action.
+func (s *Scope) HasAction(action string) bool {
+	for _, a := range s.Actions {
+		if a == action || a == Wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPattern returns true if the scope name is a pattern to expand.
+func (s *Scope) IsPattern() bool {
+	return isPattern(s.Name)
+}
+
+// Match returns true if the given repository name matches the scope name
+// pattern, or equals the scope name.
+func (s *Scope) Match(name string) bool {
+	if !s.IsPattern() {
+		return s.Name == name
+	}
+
+	match, err := compilePattern(s.Name)
+	if err != nil {
+		return false
+	}
+	return match(name)
+}
+
+// Expand returns a concrete scope, with the same type and actions, for each
+// repository matching the scope name.
+func (s *Scope) Expand(repositories []string) []*Scope {
+	out := []*Scope{}
+	for _, r := range repositories {
+		if s.Match(r) {
+			out = append(out, &Scope{
+				Type:    s.Type,
+				Class:   s.Class,
+				Name:    r,
+				Actions: append([]string{}, s.Actions...),
+			})
+		}
+	}
+	return out
+}
+
+// -----------------------------------------------------------------------------
+
+// isPattern returns true if the name is a glob or a regular expression.
+func isPattern(name string) bool {
+	return strings.HasPrefix(name, RegexpPrefix) || strings.ContainsAny(name, "*?[")
+}
+
+// compilePattern returns the matcher of a glob or regular expression name.
+func compilePattern(name string) (func(string) bool, error) {
+	if strings.HasPrefix(name, RegexpPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(name, RegexpPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid name expression %q: %v", name, err)
+		}
+		return re.MatchString, nil
+	}
+
+	if _, err := path.Match(name, ""); err != nil {
+		return nil, fmt.Errorf("invalid name pattern %q: %v", name, err)
+	}
+	return func(s string) bool {
+		ok, _ := path.Match(name, s)
+		return ok
+	}, nil
+}
+
+// validateName checks a resource name: an optional hostname followed by path
+// components.
+func validateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty resource name")
+	}
+
+	components := strings.Split(name, "/")
+	if len(components) > 1 && !componentRegexp.MatchString(components[0]) && hostnameRegexp.MatchString(components[0]) {
+		components = components[1:]
+	}
+	for _, c := range components {
+		if !componentRegexp.MatchString(c) {
+			return fmt.Errorf("invalid resource name %q", name)
+		}
+	}
+
+	return nil
+}
+
+// normalizeActions deduplicates and sorts actions, the wildcard supersedes all
+// other actions.
+func normalizeActions(actions []string) []string {
+	set := map[string]bool{}
+	for _, a := range actions {
+		if a == Wildcard {
+			return []string{Wildcard}
+		}
+		set[a] = true
+	}
+
+	out := make([]string, 0, len(set))
+	for a := range set {
+		out = append(out, a)
+	}
+	sort.Strings(out)
+
+	return out
+}
@@ -0,0 +1,240 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package scope
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   string
+		want    *Scope
+		wantErr bool
+	}{
+		{
+			name:  "repository",
+			input: "repository:library/alpine:pull",
+			want:  &Scope{Type: "repository", Name: "library/alpine", Actions: []string{"pull"}},
+		},
+		{
+			name:  "actions sorted and deduplicated",
+			input: " repository:team/app:push,pull,push ",
+			want:  &Scope{Type: "repository", Name: "team/app", Actions: []string{"pull", "push"}},
+		},
+		{
+			name:  "type with class",
+			input: "repository(plugin):vieux/sshfs:pull",
+			want:  &Scope{Type: "repository", Class: "plugin", Name: "vieux/sshfs", Actions: []string{"pull"}},
+		},
+		{
+			name:  "registry catalog",
+			input: "registry:catalog:*",
+			want:  &Scope{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+		},
+		{
+			name:  "hostname with port",
+			input: "repository:localhost:5000/team/app:pull",
+			want:  &Scope{Type: "repository", Name: "localhost:5000/team/app", Actions: []string{"pull"}},
+		},
+		{
+			name:  "hostname",
+			input: "repository:registry.example.com/app:pull",
+			want:  &Scope{Type: "repository", Name: "registry.example.com/app", Actions: []string{"pull"}},
+		},
+		{
+			name:  "wildcard folds actions",
+			input: "repository:team/app:pull,*,push",
+			want:  &Scope{Type: "repository", Name: "team/app", Actions: []string{"*"}},
+		},
+		{
+			name:  "name separators",
+			input: "repository:team/my_app.v2__x-y:pull",
+			want:  &Scope{Type: "repository", Name: "team/my_app.v2__x-y", Actions: []string{"pull"}},
+		},
+		{
+			name:  "glob pattern",
+			input: "repository:team-a/*:pull",
+			want:  &Scope{Type: "repository", Name: "team-a/*", Actions: []string{"pull"}},
+		},
+		{
+			name:  "regexp pattern",
+			input: "repository:~^team-a/(api|web)$:pull",
+			want:  &Scope{Type: "repository", Name: "~^team-a/(api|web)$", Actions: []string{"pull"}},
+		},
+		{name: "empty", input: "", wantErr: true},
+		{name: "missing actions", input: "repository:team/app", wantErr: true},
+		{name: "no action", input: "repository:team/app:", wantErr: true},
+		{name: "empty actions", input: "repository:team/app:,", wantErr: true},
+		{name: "invalid action", input: "repository:team/app:Pull", wantErr: true},
+		{name: "invalid type", input: "Repository:team/app:pull", wantErr: true},
+		{name: "invalid class", input: "repository(plugin:team/app:pull", wantErr: true},
+		{name: "empty name", input: "repository::pull", wantErr: true},
+		{name: "uppercase name", input: "repository:Team/App:pull", wantErr: true},
+		{name: "trailing slash", input: "repository:team/app/:pull", wantErr: true},
+		{name: "invalid hostname", input: "repository:-registry:5000/app:pull", wantErr: true},
+		{name: "pattern on registry type", input: "registry:cat*:*", wantErr: true},
+		{name: "invalid glob", input: "repository:team/[app:pull", wantErr: true},
+		{name: "invalid regexp", input: "repository:~team/(app:pull", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Parse(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Parse(%q) error = %v, wantErr %v", tc.input, err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Parse(%q) = %#v, want %#v", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseList(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "merged and sorted",
+			input: []string{"repository:team/web:push", "repository:team/app:pull repository:team/web:pull"},
+			want:  []string{"repository:team/app:pull", "repository:team/web:pull,push"},
+		},
+		{
+			name:  "wildcard supersedes merged actions",
+			input: []string{"repository:team/app:pull", "repository:team/app:*"},
+			want:  []string{"repository:team/app:*"},
+		},
+		{
+			name:  "class is part of the resource",
+			input: []string{"repository(plugin):team/app:pull", "repository:team/app:push"},
+			want:  []string{"repository(plugin):team/app:pull", "repository:team/app:push"},
+		},
+		{
+			name:  "empty",
+			input: []string{" "},
+			want:  []string{},
+		},
+		{
+			name:    "invalid entry",
+			input:   []string{"repository:team/app:pull", "invalid"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			scopes, err := ParseList(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseList(%q) error = %v, wantErr %v", tc.input, err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := Strings(scopes); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ParseList(%q) = %q, want %q", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeDoesNotAlias(t *testing.T) {
+	in := []*Scope{{Type: "repository", Name: "team/app", Actions: []string{"push"}}}
+	Normalize(append(in, &Scope{Type: "repository", Name: "team/app", Actions: []string{"pull"}}))
+
+	if !reflect.DeepEqual(in[0].Actions, []string{"push"}) {
+		t.Errorf("Normalize() modified its input: %q", in[0].Actions)
+	}
+}
+
+func TestHasAction(t *testing.T) {
+	testCases := []struct {
+		scope  string
+		action string
+		want   bool
+	}{
+		{scope: "repository:team/app:pull", action: "pull", want: true},
+		{scope: "repository:team/app:pull", action: "push", want: false},
+		{scope: "repository:team/app:*", action: "delete", want: true},
+	}
+
+	for _, tc := range testCases {
+		s, err := Parse(tc.scope)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", tc.scope, err)
+		}
+		if got := s.HasAction(tc.action); got != tc.want {
+			t.Errorf("%q.HasAction(%q) = %v, want %v", tc.scope, tc.action, got, tc.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	testCases := []struct {
+		scope string
+		name  string
+		want  bool
+	}{
+		{scope: "repository:team/app:pull", name: "team/app", want: true},
+		{scope: "repository:team/app:pull", name: "team/application", want: false},
+		{scope: "repository:team-a/*:pull", name: "team-a/api", want: true},
+		{scope: "repository:team-a/*:pull", name: "team-a/api/v2", want: false},
+		{scope: "repository:team-a/*:pull", name: "team-b/api", want: false},
+		{scope: "repository:team-?/api:pull", name: "team-b/api", want: true},
+		{scope: "repository:~^team-a/(api|web)$:pull", name: "team-a/web", want: true},
+		{scope: "repository:~^team-a/(api|web)$:pull", name: "team-a/worker", want: false},
+		{scope: "repository:~team-a/:pull", name: "org/team-a/api", want: true},
+	}
+
+	for _, tc := range testCases {
+		s, err := Parse(tc.scope)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", tc.scope, err)
+		}
+		if got := s.Match(tc.name); got != tc.want {
+			t.Errorf("%q.Match(%q) = %v, want %v", tc.scope, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	s, err := Parse("repository:~^team-a/:pull,push")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !s.IsPattern() {
+		t.Fatalf("%q is not a pattern", s)
+	}
+
+	got := Strings(s.Expand([]string{"team-a/api", "team-b/api", "team-a/web"}))
+	want := []string{"repository:team-a/api:pull,push", "repository:team-a/web:pull,push"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expand() = %q, want %q", got, want)
+	}
+
+	if got := s.Expand(nil); len(got) != 0 {
+		t.Errorf("Expand(nil) = %q, want none", Strings(got))
+	}
+}
@@ -0,0 +1,165 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/zntrio/vault-plugin-secrets-docker-registry/scope"
+)
+
+const (
+	scopeEnforcementIgnore = "ignore"
+	scopeEnforcementWarn   = "warn"
+	scopeEnforcementStrict = "strict"
+)
+
+// ScopeDiff describes the requested accesses missing from a token grant.
+type ScopeDiff struct {
+	// MissingResources lists requested resources (type:name) not granted at
+	// all.
+	MissingResources []string
+	// MissingActions lists, by granted resource, the requested actions not
+	// granted.
+	MissingActions map[string][]string
+}
+
+// Empty returns true when the grant covers the request.
+func (sd *ScopeDiff) Empty() bool {
+	return len(sd.MissingResources) == 0 && len(sd.MissingActions) == 0
+}
+
+// Messages returns a human readable description of each difference.
+func (sd *ScopeDiff) Messages() []string {
+	msgs := []string{}
+	for _, r := range sd.MissingResources {
+		msgs = append(msgs, fmt.Sprintf("registry did not grant any access to %q", r))
+	}
+
+	resources := make([]string, 0, len(sd.MissingActions))
+	for r := range sd.MissingActions {
+		resources = append(resources, r)
+	}
+	sort.Strings(resources)
+	for _, r := range resources {
+		msgs = append(msgs, fmt.Sprintf("registry did not grant %q actions to %q", strings.Join(sd.MissingActions[r], ","), r))
+	}
+
+	return msgs
+}
+
+// AsMap returns scope difference as map.
+func (sd *ScopeDiff) AsMap() map[string]interface{} {
+	return map[string]interface{}{
+		"missing_resources": sd.MissingResources,
+		"missing_actions":   sd.MissingActions,
+	}
+}
+
+// diffScopes compares requested scopes with the scopes granted by a token.
+func diffScopes(requested, granted []string) *ScopeDiff {
+	diff := &ScopeDiff{
+		MissingResources: []string{},
+		MissingActions:   map[string][]string{},
+	}
+
+	grants := indexGrants(granted)
+
+	for _, raw := range requested {
+		r, err := scope.Parse(raw)
+		if err != nil {
+			continue
+		}
+
+		g, ok := grants[r.Resource()]
+		if !ok {
+			diff.MissingResources = append(diff.MissingResources, r.Resource())
+			continue
+		}
+
+		for _, a := range r.Actions {
+			if !g.HasAction(a) {
+				diff.MissingActions[r.Resource()] = append(diff.MissingActions[r.Resource()], a)
+			}
+		}
+	}
+
+	return diff
+}
+
+// grantCovers returns true when the granted scopes cover every requested
+// scope. A repository pattern is covered when at least one granted resource
+// matches it with all the requested actions.
+func grantCovers(requested, granted []string) bool {
+	grants := indexGrants(granted)
+
+	for _, raw := range requested {
+		r, err := scope.Parse(raw)
+		if err != nil {
+			return false
+		}
+
+		candidates := []*scope.Scope{}
+		if r.IsPattern() {
+			for _, g := range grants {
+				if g.Type == r.Type && g.Class == r.Class && r.Match(g.Name) {
+					candidates = append(candidates, g)
+				}
+			}
+		} else if g, ok := grants[r.Resource()]; ok {
+			candidates = append(candidates, g)
+		}
+
+		covered := false
+		for _, g := range candidates {
+			covered = true
+			for _, a := range r.Actions {
+				if !g.HasAction(a) {
+					covered = false
+					break
+				}
+			}
+			if covered {
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+
+	return true
+}
+
+// indexGrants indexes granted scopes by resource, ignoring malformed grants.
+func indexGrants(granted []string) map[string]*scope.Scope {
+	grantList := []*scope.Scope{}
+	for _, raw := range granted {
+		if g, err := scope.Parse(raw); err == nil {
+			grantList = append(grantList, g)
+		}
+	}
+
+	grants := map[string]*scope.Scope{}
+	for _, g := range scope.Normalize(grantList) {
+		grants[g.Resource()] = g
+	}
+	return grants
+}
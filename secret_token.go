@@ -0,0 +1,311 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	secretTokenType = "registry_token"
+)
+
+// TokenRevoker is implemented by registry clients able to revoke issued
+// tokens upstream. Revocation is a no-op for other clients.
+type TokenRevoker interface {
+	Revoke(ctx context.Context, rt *RegistryToken) error
+}
+
+func (b *backend) secretToken() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTokenType,
+		Fields: map[string]*framework.FieldSchema{
+			"token": {
+				Type:        framework.TypeString,
+				Description: "Registry token",
+			},
+			"access_token": {
+				Type:        framework.TypeString,
+				Description: "Registry OAuth2 access token",
+			},
+		},
+
+		Renew:  b.secretTokenRenew,
+		Revoke: b.secretTokenRevoke,
+	}
+}
+
+// tokenLeaseInternalData returns the lease internal data used to renew or
+// revoke the given token.
+func tokenLeaseInternalData(roleName string, t *RegistryToken) map[string]interface{} {
+	return map[string]interface{}{
+		"role":           roleName,
+		"registry_url":   t.RegistryURL,
+		"realm":          t.Realm,
+		"service":        t.Service,
+		"request_scopes": t.RequestScopes,
+		"jti":            t.Claims.ID,
+		"expires_at":     t.ExpiresAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// multiTokenLeaseInternalData returns the lease internal data used to renew
+// or revoke the tokens of a multi-registry role.
+func multiTokenLeaseInternalData(roleName string, tokens []*RegistryToken) map[string]interface{} {
+	entries := make([]interface{}, 0, len(tokens))
+	for _, t := range tokens {
+		entry := tokenLeaseInternalData(roleName, t)
+		delete(entry, "role")
+		entry["shared"] = t.shared
+		entries = append(entries, entry)
+	}
+
+	return map[string]interface{}{
+		"role":       roleName,
+		"tokens":     entries,
+		"expires_at": earliestExpiration(tokens).UTC().Format(time.RFC3339),
+	}
+}
+
+// earliestExpiration returns the expiration of the first expiring token.
+func earliestExpiration(tokens []*RegistryToken) time.Time {
+	var expiresAt time.Time
+	for _, t := range tokens {
+		if expiresAt.IsZero() || t.ExpiresAt.Before(expiresAt) {
+			expiresAt = t.ExpiresAt
+		}
+	}
+	return expiresAt
+}
+
+// batchLeaseInternalData returns the lease internal data used to renew or
+// revoke the credentials of a batch, made of the lease internal data of each
+// role.
+func batchLeaseInternalData(roles []map[string]interface{}) map[string]interface{} {
+	entries := make([]interface{}, 0, len(roles))
+	for _, role := range roles {
+		entries = append(entries, role)
+	}
+
+	return map[string]interface{}{
+		"roles": entries,
+	}
+}
+
+// leaseRole holds the registry tokens issued to a role within a lease.
+type leaseRole struct {
+	name   string
+	shared bool
+	tokens []*RegistryToken
+}
+
+// leaseRoles decodes the role and registry token descriptions from the lease
+// internal data. Batch leases hold one entry per role.
+func leaseRoles(req *logical.Request) ([]*leaseRole, error) {
+	if req.Secret == nil {
+		return nil, errors.New("secret is nil")
+	}
+	data := req.Secret.InternalData
+
+	// Single role lease
+	entries, ok := data["roles"].([]interface{})
+	if !ok {
+		lr, err := decodeLeaseRole(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*leaseRole{lr}, nil
+	}
+
+	roles := make([]*leaseRole, 0, len(entries))
+	for _, entry := range entries {
+		m, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid lease role entry")
+		}
+		lr, err := decodeLeaseRole(m)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, lr)
+	}
+
+	return roles, nil
+}
+
+// decodeLeaseRole decodes the registry tokens issued to a role.
+func decodeLeaseRole(data map[string]interface{}) (*leaseRole, error) {
+	lr := &leaseRole{}
+	lr.name, _ = data["role"].(string)
+	lr.shared, _ = data["shared"].(bool)
+
+	// Single registry role
+	entries, ok := data["tokens"].([]interface{})
+	if !ok {
+		rt, err := decodeLeaseToken(data)
+		if err != nil {
+			return nil, err
+		}
+		lr.tokens = []*RegistryToken{rt}
+		return lr, nil
+	}
+
+	for _, entry := range entries {
+		m, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid lease token entry")
+		}
+		rt, err := decodeLeaseToken(m)
+		if err != nil {
+			return nil, err
+		}
+		lr.tokens = append(lr.tokens, rt)
+	}
+
+	return lr, nil
+}
+
+// decodeLeaseToken decodes a registry token description.
+func decodeLeaseToken(data map[string]interface{}) (*RegistryToken, error) {
+	rawExpiresAt, _ := data["expires_at"].(string)
+	expiresAt, err := time.Parse(time.RFC3339, rawExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lease expiration: %v", err)
+	}
+
+	rt := &RegistryToken{
+		ExpiresAt: expiresAt,
+	}
+	rt.RegistryURL, _ = data["registry_url"].(string)
+	rt.Realm, _ = data["realm"].(string)
+	rt.Service, _ = data["service"].(string)
+	rt.Claims.ID, _ = data["jti"].(string)
+	rt.shared, _ = data["shared"].(bool)
+	switch scopes := data["request_scopes"].(type) {
+	case []string:
+		rt.RequestScopes = scopes
+	case []interface{}:
+		for _, s := range scopes {
+			if str, ok := s.(string); ok {
+				rt.RequestScopes = append(rt.RequestScopes, str)
+			}
+		}
+	}
+
+	return rt, nil
+}
+
+// secretTokenRenew extends the lease up to the registry token expiration.
+// Registry tokens can't be extended, expired tokens are refused. Batch leases
+// are extended up to the earliest limit of their roles.
+func (b *backend) secretTokenRenew(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	roles, err := leaseRoles(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{Secret: req.Secret}
+	for i, lr := range roles {
+		expiresAt := earliestExpiration(lr.tokens)
+		if !time.Now().Before(expiresAt) {
+			return nil, logical.CodedError(400, fmt.Sprintf("registry token of role %q has expired, request new credentials", lr.name))
+		}
+
+		role, err := b.Role(ctx, req.Storage, lr.name)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return nil, logical.CodedError(400, fmt.Sprintf("role %q no longer exists", lr.name))
+		}
+
+		ttl, maxTTL := role.LeaseTTL(expiresAt)
+		if i == 0 || ttl < resp.Secret.TTL {
+			resp.Secret.TTL = ttl
+		}
+		if i == 0 || maxTTL < resp.Secret.MaxTTL {
+			resp.Secret.MaxTTL = maxTTL
+		}
+	}
+
+	return resp, nil
+}
+
+// secretTokenRevoke calls the client revocation hook, when implemented.
+// Tokens shared through the role cache or with concurrent requests are not
+// revoked upstream.
+func (b *backend) secretTokenRevoke(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	roles, err := leaseRoles(req)
+	if err != nil {
+		return nil, err
+	}
+
+	engine, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	client, err := b.Client(engine)
+	if err != nil {
+		return nil, err
+	}
+
+	revoker, ok := client.(TokenRevoker)
+	if !ok {
+		return nil, nil
+	}
+	for _, lr := range roles {
+		if lr.shared {
+			continue
+		}
+		for _, rt := range lr.tokens {
+			// Expired and shared tokens don't need any revocation
+			if rt.shared || !time.Now().Before(rt.ExpiresAt) {
+				continue
+			}
+			if err := revoker.Revoke(ctx, rt); err != nil {
+				return nil, errwrap.Wrapf("unable to revoke registry token: {{err}}", err)
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// revokeTokens revokes tokens issued by a failed request, when the client
+// implements revocation. Shared tokens are kept, errors are only logged.
+func (b *backend) revokeTokens(ctx context.Context, client RegistryClient, tokens []*RegistryToken) {
+	revoker, ok := client.(TokenRevoker)
+	if !ok {
+		return
+	}
+	for _, rt := range tokens {
+		if rt.shared {
+			continue
+		}
+		if err := revoker.Revoke(ctx, rt); err != nil {
+			b.Logger().Warn("unable to revoke registry token", "registry_url", rt.RegistryURL, "error", err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// leaseJTI returns the token identifier of a single registry lease.
+func leaseJTI(t *testing.T, resp *logical.Response) string {
+	t.Helper()
+
+	jti, _ := resp.Data["claims"].(map[string]interface{})["jti"].(string)
+	if jti == "" {
+		t.Fatalf("no jti in response: %#v", resp.Data)
+	}
+	return jti
+}
+
+func TestTokenLeaseTTL(t *testing.T) {
+	testCases := []struct {
+		name       string
+		tokenTTL   time.Duration
+		role       map[string]interface{}
+		wantTTL    time.Duration
+		wantMaxTTL time.Duration
+	}{
+		{
+			name:       "capped by token expiry",
+			tokenTTL:   2 * time.Minute,
+			role:       map[string]interface{}{"ttl": "10m", "max_ttl": "1h"},
+			wantTTL:    2 * time.Minute,
+			wantMaxTTL: 2 * time.Minute,
+		},
+		{
+			name:       "shortened by role ttl",
+			tokenTTL:   time.Hour,
+			role:       map[string]interface{}{"ttl": "5m", "max_ttl": "20m"},
+			wantTTL:    5 * time.Minute,
+			wantMaxTTL: 20 * time.Minute,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			r.ttl = tc.tokenTTL
+			b, s, _ := testBackend(t, r, nil)
+
+			role := map[string]interface{}{"scopes": []string{"repository:team-a/api:pull"}}
+			for k, v := range tc.role {
+				role[k] = v
+			}
+			testRequest(t, b, s, logical.CreateOperation, "roles/pull", role)
+
+			resp := testRequest(t, b, s, logical.ReadOperation, "creds/pull", nil)
+			if resp.Secret == nil {
+				t.Fatal("expected a lease")
+			}
+			// The remaining token lifetime is slightly below its TTL
+			if got := resp.Secret.TTL; got > tc.wantTTL || got < tc.wantTTL-time.Minute {
+				t.Errorf("TTL = %s, want about %s", got, tc.wantTTL)
+			}
+			if got := resp.Secret.MaxTTL; got > tc.wantMaxTTL || got < tc.wantMaxTTL-time.Minute {
+				t.Errorf("MaxTTL = %s, want about %s", got, tc.wantMaxTTL)
+			}
+
+			// Renewal keeps the same limits
+			renewed, err := testSecretRequest(t, b, s, logical.RenewOperation, resp.Secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := renewed.Secret.TTL; got > tc.wantTTL {
+				t.Errorf("renewed TTL = %s, want at most %s", got, tc.wantTTL)
+			}
+		})
+	}
+}
+
+func TestTokenLeaseRenewExpired(t *testing.T) {
+	r := newTestRegistry(t)
+	b, s, _ := testBackend(t, r, nil)
+
+	testRequest(t, b, s, logical.CreateOperation, "roles/pull", map[string]interface{}{
+		"scopes": []string{"repository:team-a/api:pull"},
+	})
+	resp := testRequest(t, b, s, logical.ReadOperation, "creds/pull", nil)
+
+	// The registry token has expired
+	resp.Secret.InternalData["expires_at"] = time.Now().Add(-time.Second).UTC().Format(time.RFC3339)
+	renewed, err := testSecretRequest(t, b, s, logical.RenewOperation, resp.Secret)
+	if code := testErrorCode(renewed, err); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d: %v", http.StatusBadRequest, code, err)
+	}
+
+	// Deleted roles can't be renewed either
+	resp = testRequest(t, b, s, logical.ReadOperation, "creds/pull", nil)
+	testRequest(t, b, s, logical.DeleteOperation, "roles/pull", nil)
+	renewed, err = testSecretRequest(t, b, s, logical.RenewOperation, resp.Secret)
+	if code := testErrorCode(renewed, err); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d: %v", http.StatusBadRequest, code, err)
+	}
+}
+
+func TestTokenLeaseRevoke(t *testing.T) {
+	r := newTestRegistry(t)
+	b, s, client := testBackend(t, r, nil)
+
+	testRequest(t, b, s, logical.CreateOperation, "roles/pull", map[string]interface{}{
+		"scopes": []string{"repository:team-a/api:pull"},
+	})
+	testRequest(t, b, s, logical.CreateOperation, "roles/shared", map[string]interface{}{
+		"scopes": []string{"repository:team-a/web:pull"},
+		"cache":  true,
+	})
+
+	// Cached tokens are shared with other leases
+	shared := testRequest(t, b, s, logical.ReadOperation, "creds/shared", nil)
+	if _, err := testSecretRequest(t, b, s, logical.RevokeOperation, shared.Secret); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.revokedTokens(); len(got) != 0 {
+		t.Fatalf("shared token revoked: %v", got)
+	}
+
+	// Expired tokens don't need a revocation
+	expired := testRequest(t, b, s, logical.ReadOperation, "creds/pull", nil)
+	expired.Secret.InternalData["expires_at"] = time.Now().Add(-time.Second).UTC().Format(time.RFC3339)
+	if _, err := testSecretRequest(t, b, s, logical.RevokeOperation, expired.Secret); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.revokedTokens(); len(got) != 0 {
+		t.Fatalf("expired token revoked: %v", got)
+	}
+
+	// Other tokens are revoked upstream
+	resp := testRequest(t, b, s, logical.ReadOperation, "creds/pull", nil)
+	if _, err := testSecretRequest(t, b, s, logical.RevokeOperation, resp.Secret); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := client.revokedTokens(), []string{leaseJTI(t, resp)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("revoked tokens = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Metric labels only take values from small fixed sets (outcomes, endpoint
+// kinds, status codes), or role names which are bounded by the mount
+// configuration.
+const (
+	outcomeSuccess = "success"
+
+	endpointChallenge = "challenge"
+	endpointToken     = "token"
+	endpointList      = "list"
+	endpointRateLimit = "ratelimit"
+
+	cacheToken   = "token"
+	cacheCatalog = "catalog"
+)
+
+// metricName returns the metric key under the plugin prefix.
+func metricName(parts ...string) []string {
+	return append([]string{"secrets", "docker-registry"}, parts...)
+}
+
+// errorClass returns the metric label of an error, derived from the coded
+// error status.
+func errorClass(err error) string {
+	var coded logical.HTTPCodedError
+	if !errors.As(err, &coded) {
+		return "internal"
+	}
+
+	switch coded.Code() {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusForbidden:
+		return "denied"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusBadGateway:
+		return "upstream"
+	default:
+		return "error"
+	}
+}
+
+// emitIssuance counts a credential request of a role by outcome.
+func emitIssuance(roleName string, err error) {
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = errorClass(err)
+	}
+
+	metrics.IncrCounterWithLabels(metricName("creds", "issue"), 1, []metrics.Label{
+		{Name: "role", Value: roleName},
+		{Name: "outcome", Value: outcome},
+	})
+}
+
+// emitUpstream records the latency and status of a registry request.
+func emitUpstream(endpoint string, start time.Time, resp *http.Response) {
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	labels := []metrics.Label{
+		{Name: "endpoint", Value: endpoint},
+		{Name: "status", Value: status},
+	}
+
+	metrics.MeasureSinceWithLabels(metricName("upstream", "request"), start, labels)
+	metrics.IncrCounterWithLabels(metricName("upstream", "response"), 1, labels)
+}
+
+// emitRetry counts a retried upstream call.
+func emitRetry() {
+	metrics.IncrCounter(metricName("upstream", "retry"), 1)
+}
+
+// emitCache counts a cache lookup.
+func emitCache(cache string, hit bool) {
+	name := metricName("cache", "miss")
+	if hit {
+		name = metricName("cache", "hit")
+	}
+	metrics.IncrCounterWithLabels(name, 1, []metrics.Label{
+		{Name: "cache", Value: cache},
+	})
+}
+
+// emitCoalesced counts a token request merged with an in-flight one.
+func emitCoalesced() {
+	metrics.IncrCounter(metricName("token", "coalesced"), 1)
+}
+
+// emitScopeMismatch counts the tokens granting less than the requested
+// scopes, by role and enforcement mode.
+func emitScopeMismatch(roleName, mode string) {
+	metrics.IncrCounterWithLabels(metricName("creds", "scope_mismatch"), 1, []metrics.Label{
+		{Name: "role", Value: roleName},
+		{Name: "mode", Value: mode},
+	})
+}
@@ -0,0 +1,243 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// tokenCacheRefreshWindow is the remaining lifetime, in addition to the
+	// role threshold, below which hot entries are refreshed. It covers the
+	// interval between two periodic function calls.
+	tokenCacheRefreshWindow = 2 * time.Minute
+)
+
+// tokenCacheEntry is a registry token shared by the requests of a role.
+type tokenCacheEntry struct {
+	role        string
+	registryURL string
+	service     string
+	scopes      []string
+	offline     bool
+
+	token    *RegistryToken
+	expanded map[string][]string
+
+	// hits counts the requests served since the last refresh.
+	hits int
+}
+
+// tokenCache holds the registry tokens of the roles with cache enabled.
+type tokenCache struct {
+	sync.Mutex
+	entries map[string]*tokenCacheEntry
+}
+
+// tokenCacheKey identifies a token request of a role.
+func tokenCacheKey(roleName, registryURL, service string, scopes []string, offline bool) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%t", roleName, registryURL, service, strings.Join(scopes, " "), offline)
+}
+
+// get returns the cached token if its remaining lifetime is above minTTL.
+func (tc *tokenCache) get(key string, minTTL time.Duration) *tokenCacheEntry {
+	tc.Lock()
+	defer tc.Unlock()
+
+	e, ok := tc.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Until(e.token.ExpiresAt) <= minTTL {
+		return nil
+	}
+	e.hits++
+
+	return e
+}
+
+// put stores a token entry.
+func (tc *tokenCache) put(key string, e *tokenCacheEntry) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	if tc.entries == nil {
+		tc.entries = map[string]*tokenCacheEntry{}
+	}
+	tc.entries[key] = e
+}
+
+// dropRole removes the entries of the given role.
+func (tc *tokenCache) dropRole(roleName string) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	for k, e := range tc.entries {
+		if e.role == roleName {
+			delete(tc.entries, k)
+		}
+	}
+}
+
+// reset removes all entries.
+func (tc *tokenCache) reset() {
+	tc.Lock()
+	tc.entries = nil
+	tc.Unlock()
+}
+
+// snapshot returns a copy of the entries, each entry hit counter is reset.
+func (tc *tokenCache) snapshot() map[string]tokenCacheEntry {
+	tc.Lock()
+	defer tc.Unlock()
+
+	out := make(map[string]tokenCacheEntry, len(tc.entries))
+	for k, e := range tc.entries {
+		out[k] = *e
+		e.hits = 0
+	}
+	return out
+}
+
+// remove deletes the entry if it still holds the given token.
+func (tc *tokenCache) remove(key string, t *RegistryToken) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	if e, ok := tc.entries[key]; ok && e.token == t {
+		delete(tc.entries, key)
+	}
+}
+
+// replace updates the entry if it still holds the given token, entries
+// dropped or replaced meanwhile are left untouched.
+func (tc *tokenCache) replace(key string, t *RegistryToken, e *tokenCacheEntry) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	if current, ok := tc.entries[key]; ok && current.token == t {
+		tc.entries[key] = e
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// roleToken returns a registry token for the role, served from the cache when
+// the role enables it.
+func (b *backend) roleToken(ctx context.Context, engine *Config, client RegistryClient, role *Role, service string, scopes []string) (*RegistryToken, map[string][]string, bool, error) {
+	if !role.Cache {
+		t, expanded, err := b.issueToken(ctx, engine, client, service, scopes, role.OfflineToken)
+		return t, expanded, false, err
+	}
+
+	key := tokenCacheKey(role.Name, engine.RegistryURL, service, scopes, role.OfflineToken)
+	e := b.tokenCache.get(key, role.cacheMinTTL())
+	emitCache(cacheToken, e != nil)
+	if e != nil {
+		return e.token, e.expanded, true, nil
+	}
+
+	t, expanded, err := b.issueToken(ctx, engine, client, service, scopes, role.OfflineToken)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	b.tokenCache.put(key, &tokenCacheEntry{
+		role:        role.Name,
+		registryURL: engine.RegistryURL,
+		service:     service,
+		scopes:      scopes,
+		offline:     role.OfflineToken,
+		token:       t,
+		expanded:    expanded,
+	})
+
+	return t, expanded, false, nil
+}
+
+// periodicRefreshTokenCache renews the cached tokens used since the last run
+// before they expire, and evicts the others once they are no longer served.
+func (b *backend) periodicRefreshTokenCache(ctx context.Context, s logical.Storage) error {
+	entries := b.tokenCache.snapshot()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	engine, err := b.Config(ctx, s)
+	if err != nil {
+		return err
+	}
+	client, err := b.Client(engine)
+	if err != nil {
+		return err
+	}
+
+	roles := map[string]*Role{}
+	for key, e := range entries {
+		role, ok := roles[e.role]
+		if !ok {
+			if role, err = b.Role(ctx, s, e.role); err != nil {
+				return err
+			}
+			roles[e.role] = role
+		}
+
+		// Role deleted or cache disabled
+		if role == nil || !role.Cache {
+			b.tokenCache.remove(key, e.token)
+			continue
+		}
+
+		remaining := time.Until(e.token.ExpiresAt)
+		if remaining > role.cacheMinTTL()+tokenCacheRefreshWindow {
+			continue
+		}
+		if e.hits == 0 {
+			if remaining <= role.cacheMinTTL() {
+				b.tokenCache.remove(key, e.token)
+			}
+			continue
+		}
+
+		target := engine
+		if rr := role.registry(e.registryURL, engine.RegistryURL); rr != nil {
+			target = engine.ForRegistry(rr)
+		} else if e.registryURL != engine.RegistryURL {
+			// Registry no longer declared by the role
+			b.tokenCache.remove(key, e.token)
+			continue
+		}
+
+		// Renew hot entry
+		t, expanded, err := b.issueToken(ctx, target, client, e.service, e.scopes, e.offline)
+		if err != nil {
+			b.Logger().Warn("unable to refresh cached registry token", "role", e.role, "error", err)
+			continue
+		}
+		renewed := e
+		renewed.token, renewed.expanded, renewed.hits = t, expanded, 0
+		b.tokenCache.replace(key, e.token, &renewed)
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestTokenCache(t *testing.T) {
+	r := newTestRegistry(t)
+	b, s, _ := testBackend(t, r, nil)
+
+	testRequest(t, b, s, logical.CreateOperation, "roles/shared", map[string]interface{}{
+		"scopes":        []string{"repository:team-a/api:pull"},
+		"cache":         true,
+		"cache_min_ttl": "1m",
+	})
+
+	first := testRequest(t, b, s, logical.ReadOperation, "creds/shared", nil)
+	second := testRequest(t, b, s, logical.ReadOperation, "creds/shared", nil)
+	if cached := first.Data["cached"].(bool); cached {
+		t.Error("first token reported as cached")
+	}
+	if cached := second.Data["cached"].(bool); !cached {
+		t.Error("second token not served from the cache")
+	}
+	if leaseJTI(t, first) != leaseJTI(t, second) {
+		t.Error("cached token not shared")
+	}
+	if shared := second.Secret.InternalData["shared"].(bool); !shared {
+		t.Error("cached token lease not flagged as shared")
+	}
+	if requests, _ := r.counters(); requests != 1 {
+		t.Errorf("token requests = %d, want 1", requests)
+	}
+
+	// A role change drops its cached tokens
+	testRequest(t, b, s, logical.UpdateOperation, "roles/shared", map[string]interface{}{
+		"cache_min_ttl": "30s",
+	})
+	third := testRequest(t, b, s, logical.ReadOperation, "creds/shared", nil)
+	if cached := third.Data["cached"].(bool); cached {
+		t.Error("token served from the cache after a role change")
+	}
+	if requests, _ := r.counters(); requests != 2 {
+		t.Errorf("token requests = %d, want 2", requests)
+	}
+}
+
+func TestTokenCacheMinTTL(t *testing.T) {
+	r := newTestRegistry(t)
+	r.ttl = 2 * time.Minute
+	b, s, _ := testBackend(t, r, nil)
+
+	// Tokens expiring before cache_min_ttl are not served from the cache
+	testRequest(t, b, s, logical.CreateOperation, "roles/shared", map[string]interface{}{
+		"scopes":        []string{"repository:team-a/api:pull"},
+		"cache":         true,
+		"cache_min_ttl": "5m",
+	})
+
+	testRequest(t, b, s, logical.ReadOperation, "creds/shared", nil)
+	resp := testRequest(t, b, s, logical.ReadOperation, "creds/shared", nil)
+	if cached := resp.Data["cached"].(bool); cached {
+		t.Error("token below cache_min_ttl served from the cache")
+	}
+	if requests, _ := r.counters(); requests != 2 {
+		t.Errorf("token requests = %d, want 2", requests)
+	}
+}
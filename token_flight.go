@@ -0,0 +1,86 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"sync"
+)
+
+// tokenFlight is a token request shared by identical concurrent requests.
+type tokenFlight struct {
+	done  chan struct{}
+	token *RegistryToken
+	err   error
+
+	// shared is set when several callers wait for the flight.
+	shared bool
+}
+
+// tokenFlightGroup merges identical concurrent token requests.
+type tokenFlightGroup struct {
+	sync.Mutex
+	flights map[string]*tokenFlight
+}
+
+// do calls fetch once for all concurrent calls with the same key. fetch runs
+// with fetchCtx, so that a caller leaving does not cancel the request for the
+// others, each caller only waits until its own context is done. Callers get
+// their own copy of the token, and whether it was handed to other callers.
+func (g *tokenFlightGroup) do(ctx, fetchCtx context.Context, key string, fetch func(context.Context) (*RegistryToken, error)) (*RegistryToken, bool, error) {
+	g.Lock()
+	if g.flights == nil {
+		g.flights = map[string]*tokenFlight{}
+	}
+	f, merged := g.flights[key]
+	if merged {
+		f.shared = true
+	} else {
+		f = &tokenFlight{
+			done: make(chan struct{}),
+		}
+		g.flights[key] = f
+
+		go func() {
+			f.token, f.err = fetch(fetchCtx)
+
+			g.Lock()
+			delete(g.flights, key)
+			g.Unlock()
+			close(f.done)
+		}()
+	}
+	g.Unlock()
+
+	if merged {
+		emitCoalesced()
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case <-f.done:
+	}
+	if f.err != nil {
+		return nil, false, f.err
+	}
+
+	// Waiters only join before the flight is done, shared is final
+	t := *f.token
+	return &t, f.shared, nil
+}
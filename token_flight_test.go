@@ -0,0 +1,109 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenFlightGroup(t *testing.T) {
+	var (
+		g       tokenFlightGroup
+		calls   int32
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+
+	fetch := func(context.Context) (*RegistryToken, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &RegistryToken{Token: "token"}, nil
+	}
+
+	// Concurrent callers share a single fetch
+	const callers = 3
+	tokens := make([]*RegistryToken, callers)
+	shared := make([]bool, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			tokens[i], shared[i], err = g.do(context.Background(), context.Background(), "key", fetch)
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	// Let all callers join the flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("fetch called %d times, want 1", n)
+	}
+	for i := range tokens {
+		if tokens[i] == nil || tokens[i].Token != "token" || !shared[i] {
+			t.Errorf("caller %d got %#v, shared %v", i, tokens[i], shared[i])
+		}
+	}
+	if tokens[0] == tokens[1] {
+		t.Error("callers share the same token instance")
+	}
+
+	// A lone caller gets an unshared token
+	token, isShared, err := g.do(context.Background(), context.Background(), "key", func(context.Context) (*RegistryToken, error) {
+		return &RegistryToken{Token: "lone"}, nil
+	})
+	if err != nil || token.Token != "lone" || isShared {
+		t.Errorf("do() = %#v, %v, %v", token, isShared, err)
+	}
+
+	// Errors are returned to the caller
+	wantErr := errors.New("upstream failure")
+	if _, _, err := g.do(context.Background(), context.Background(), "key", func(context.Context) (*RegistryToken, error) {
+		return nil, wantErr
+	}); err != wantErr {
+		t.Errorf("do() error = %v, want %v", err, wantErr)
+	}
+}
+
+func TestTokenFlightGroupCallerCancel(t *testing.T) {
+	var g tokenFlightGroup
+	release := make(chan struct{})
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The caller leaves, the fetch keeps its own context
+	fetchCtx := context.Background()
+	_, _, err := g.do(ctx, fetchCtx, "key", func(ctx context.Context) (*RegistryToken, error) {
+		<-release
+		return &RegistryToken{}, ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Errorf("do() error = %v, want %v", err, context.Canceled)
+	}
+}
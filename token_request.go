@@ -0,0 +1,160 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// tokenFlowBasic uses the legacy GET /token endpoint with basic
+	// authentication.
+	tokenFlowBasic = "basic"
+	// tokenFlowOAuth2 uses the POST /token OAuth2 endpoint with password or
+	// refresh_token grants.
+	tokenFlowOAuth2 = "oauth2"
+
+	// defaultOAuth2ClientID is sent when no client_id is configured, the
+	// OAuth2 flow requires one.
+	defaultOAuth2ClientID = "vault-plugin-secrets-docker-registry"
+)
+
+// TokenRequest describes a token request sent to the registry token service.
+type TokenRequest struct {
+	Flow         string
+	Realm        string
+	ClientID     string
+	Username     string
+	Password     string
+	RefreshToken string
+	Service      string
+	Scopes       []string
+	Offline      bool
+	ClockSkew    time.Duration
+
+	// verifier checks the issued token, claims are decoded without signature
+	// verification when nil.
+	verifier *tokenVerifier
+}
+
+// Scope returns the space separated request scope.
+func (tr *TokenRequest) Scope() string {
+	return strings.Join(tr.Scopes, " ")
+}
+
+// Key identifies identical token requests, including how the issued token is
+// verified. Credentials are hashed.
+func (tr *TokenRequest) Key() string {
+	h := sha256.New()
+	for _, v := range []string{tr.Flow, tr.Realm, tr.ClientID, tr.Username, tr.Password, tr.RefreshToken, tr.Service, tr.Scope(), strconv.FormatBool(tr.Offline), tr.ClockSkew.String(), tr.verifier.fingerprint()} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// basicRequest prepares a legacy token request.
+func (tr *TokenRequest) basicRequest(ctx context.Context, endpointURL *url.URL) (*http.Request, error) {
+	if tr.RefreshToken != "" && tr.Password == "" {
+		return nil, errors.New("refresh token authentication requires the oauth2 token flow")
+	}
+
+	// Prepare params, keep the ones provided by the realm
+	params := endpointURL.Query()
+
+	if tr.ClientID != "" {
+		params.Add("client_id", tr.ClientID)
+	}
+	if tr.Service != "" {
+		params.Add("service", tr.Service)
+	}
+	if scope := tr.Scope(); scope != "" {
+		params.Add("scope", scope)
+	}
+	if tr.Username != "" {
+		params.Add("account", tr.Username)
+	}
+	if tr.Offline {
+		params.Add("offline_token", "true")
+	}
+	endpointURL.RawQuery = params.Encode()
+
+	// Prepare request
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpointURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Assign basic authentication if credentials provided
+	if tr.Username != "" && tr.Password != "" {
+		req.SetBasicAuth(tr.Username, tr.Password)
+	}
+
+	return req, nil
+}
+
+// oauth2Request prepares an OAuth2 token request, the refresh_token grant is
+// preferred when a refresh token is available.
+func (tr *TokenRequest) oauth2Request(ctx context.Context, endpointURL *url.URL) (*http.Request, error) {
+	form := url.Values{}
+
+	switch {
+	case tr.RefreshToken != "":
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", tr.RefreshToken)
+	case tr.Username != "" && tr.Password != "":
+		form.Set("grant_type", "password")
+		form.Set("username", tr.Username)
+		form.Set("password", tr.Password)
+	default:
+		return nil, errors.New("oauth2 token flow requires a refresh token or username and password")
+	}
+
+	clientID := tr.ClientID
+	if clientID == "" {
+		clientID = defaultOAuth2ClientID
+	}
+	form.Set("client_id", clientID)
+
+	if tr.Service != "" {
+		form.Set("service", tr.Service)
+	}
+	if scope := tr.Scope(); scope != "" {
+		form.Set("scope", scope)
+	}
+	if tr.Offline {
+		form.Set("access_type", "offline")
+	}
+
+	// Prepare request
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpointURL.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return req, nil
+}
@@ -0,0 +1,58 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenRequestKey(t *testing.T) {
+	engine := DefaultConfig()
+	engine.Username, engine.Password = "robot", "secret"
+
+	base, err := engine.TokenRequest("https://auth.example.com/token", "registry.example.com", []string{"repository:team/app:pull"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := engine.TokenRequest("https://auth.example.com/token", "registry.example.com", []string{"repository:team/app:pull"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base.Key() != same.Key() {
+		t.Error("identical token requests have different keys")
+	}
+
+	testCases := map[string]func(c *Config){
+		"password":     func(c *Config) { c.Password = "other" },
+		"token issuer": func(c *Config) { c.TokenIssuer = "registry-token-issuer" },
+		"jwks":         func(c *Config) { c.JWKS = testJWKS(t) },
+		"clock skew":   func(c *Config) { c.ClockSkew = time.Minute },
+	}
+	for name, update := range testCases {
+		c := *engine
+		update(&c)
+		tr, err := c.TokenRequest("https://auth.example.com/token", "registry.example.com", []string{"repository:team/app:pull"})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if tr.Key() == base.Key() {
+			t.Errorf("%s: token requests verified differently share the same key", name)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/vault/sdk/framework"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	defaultTLSMinVersion = "tls12"
+	defaultHTTPTimeout   = 30 * time.Second
+)
+
+var tlsVersions = map[string]uint16{
+	"tls10": tls.VersionTLS10,
+	"tls11": tls.VersionTLS11,
+	"tls12": tls.VersionTLS12,
+	"tls13": tls.VersionTLS13,
+}
+
+// TransportConfig holds the registry HTTP client settings.
+type TransportConfig struct {
+	CACertificate      string   `json:"ca_certificate"`
+	ClientCertificate  string   `json:"client_certificate"`
+	ClientKey          string   `json:"client_key"`
+	TLSMinVersion      string   `json:"tls_min_version"`
+	ProxyURL           string   `json:"proxy_url"`
+	NoProxy            []string `json:"no_proxy"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify"`
+}
+
+// Update updates the transport settings from the given field data.
+func (tc *TransportConfig) Update(d *framework.FieldData) (bool, error) {
+	if d == nil {
+		return false, nil
+	}
+
+	changed := false
+
+	if v, ok := d.GetOk("ca_certificate"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != tc.CACertificate {
+			tc.CACertificate = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("client_certificate"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != tc.ClientCertificate {
+			tc.ClientCertificate = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("client_key"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != tc.ClientKey {
+			tc.ClientKey = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("tls_min_version"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != tc.TLSMinVersion {
+			tc.TLSMinVersion = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("proxy_url"); ok {
+		nv := strings.TrimSpace(v.(string))
+		if nv != tc.ProxyURL {
+			tc.ProxyURL = nv
+			changed = true
+		}
+	}
+
+	if v, ok := d.GetOk("no_proxy"); ok {
+		tc.NoProxy = v.([]string)
+		changed = true
+	}
+
+	if v, ok := d.GetOk("insecure_skip_verify"); ok {
+		nv := v.(bool)
+		if nv != tc.InsecureSkipVerify {
+			tc.InsecureSkipVerify = nv
+			changed = true
+		}
+	}
+
+	// Validate settings
+	if _, err := tc.HTTPClient(); err != nil {
+		return false, err
+	}
+
+	return changed, nil
+}
+
+// Fingerprint returns a digest of the settings, used to detect changes
+// requiring a new HTTP client.
+func (tc *TransportConfig) Fingerprint() string {
+	payload, err := json.Marshal(tc)
+	if err != nil {
+		return ""
+	}
+
+	h := sha256.Sum256(payload)
+	return hex.EncodeToString(h[:])
+}
+
+// HTTPClient builds an HTTP client from the transport settings.
+func (tc *TransportConfig) HTTPClient() (*http.Client, error) {
+	tlsConfig, err := tc.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := cleanhttp.DefaultPooledTransport()
+	transport.TLSClientConfig = tlsConfig
+
+	// Assign proxy settings
+	if tc.ProxyURL != "" {
+		u, err := url.Parse(tc.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_url is not a valid URL: %v", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("proxy_url %q must include a scheme and a host", tc.ProxyURL)
+		}
+
+		proxy := &httpproxy.Config{
+			HTTPProxy:  tc.ProxyURL,
+			HTTPSProxy: tc.ProxyURL,
+			NoProxy:    strings.Join(tc.NoProxy, ","),
+		}
+		proxyFunc := proxy.ProxyFunc()
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	} else {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   defaultHTTPTimeout,
+	}, nil
+}
+
+// tlsConfig builds the TLS client configuration.
+func (tc *TransportConfig) tlsConfig() (*tls.Config, error) {
+	minVersion := tc.TLSMinVersion
+	if minVersion == "" {
+		minVersion = defaultTLSMinVersion
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("tls_min_version %q is not supported", minVersion)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         version,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+	}
+
+	// Assign custom CA bundle
+	if tc.CACertificate != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(tc.CACertificate)) {
+			return nil, errors.New("ca_certificate does not contain any PEM certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// Assign client certificate
+	switch {
+	case tc.ClientCertificate != "" && tc.ClientKey != "":
+		cert, err := tls.X509KeyPair([]byte(tc.ClientCertificate), []byte(tc.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case tc.ClientCertificate != "" || tc.ClientKey != "":
+		return nil, errors.New("client_certificate and client_key must be set together")
+	}
+
+	return tlsConfig, nil
+}
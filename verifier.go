@@ -0,0 +1,256 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/square/go-jose/v3"
+	"github.com/square/go-jose/v3/jwt"
+)
+
+// tokenVerifier checks registry token signatures and claims against the
+// trusted material declared in the engine configuration.
+type tokenVerifier struct {
+	roots  *x509.CertPool
+	certs  []*x509.Certificate
+	keys   *jose.JSONWebKeySet
+	issuer string
+
+	// source identifies the trusted material the verifier was built from.
+	source string
+}
+
+// newTokenVerifier builds a verifier from a PEM certificate bundle and/or a
+// JWKS document. Without trusted material the verifier only checks the
+// issuer of unverified claims, it returns nil when nothing is given.
+func newTokenVerifier(certificates, jwks, issuer string) (*tokenVerifier, error) {
+	if certificates == "" && jwks == "" && issuer == "" {
+		return nil, nil
+	}
+
+	h := sha256.New()
+	for _, m := range []string{certificates, jwks, issuer} {
+		h.Write([]byte(m))
+		h.Write([]byte{0})
+	}
+	v := &tokenVerifier{
+		roots:  x509.NewCertPool(),
+		issuer: issuer,
+		source: hex.EncodeToString(h.Sum(nil)),
+	}
+
+	// Decode certificate bundle
+	rest := []byte(certificates)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse trusted certificate: %v", err)
+		}
+		v.roots.AddCert(cert)
+		v.certs = append(v.certs, cert)
+	}
+	if certificates != "" && len(v.certs) == 0 {
+		return nil, errors.New("trusted_certificates does not contain any PEM certificate")
+	}
+
+	// Decode key set
+	if jwks != "" {
+		var keys jose.JSONWebKeySet
+		if err := json.Unmarshal([]byte(jwks), &keys); err != nil {
+			return nil, fmt.Errorf("unable to parse jwks: %v", err)
+		}
+		if len(keys.Keys) == 0 {
+			return nil, errors.New("jwks does not contain any key")
+		}
+		v.keys = &keys
+	}
+
+	return v, nil
+}
+
+// fingerprint identifies the verification settings, empty when nothing is
+// checked.
+func (v *tokenVerifier) fingerprint() string {
+	if v == nil {
+		return ""
+	}
+	return v.source
+}
+
+// canVerifySignature returns true when trusted material is configured.
+func (v *tokenVerifier) canVerifySignature() bool {
+	return v != nil && (len(v.certs) > 0 || v.keys != nil)
+}
+
+// verify decodes the token claims, checks the token signature when trusted
+// material is configured, then validates iss, aud and the validity window
+// with the given clock skew allowance.
+func (v *tokenVerifier) verify(raw, audience string, now time.Time, leeway time.Duration) (*jwtClaims, error) {
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse token: %v", err)
+	}
+
+	var claims jwtClaims
+	if !v.canVerifySignature() {
+		// No trusted material, signature can't be checked
+		if err := token.UnsafeClaimsWithoutVerification(&claims); err != nil {
+			return nil, fmt.Errorf("unable to extract token claims: %v", err)
+		}
+	} else {
+		if err := v.verifySignature(token, &claims); err != nil {
+			return nil, err
+		}
+	}
+
+	// Validate claims
+	expected := jwt.Expected{
+		Time: now,
+	}
+	if v != nil {
+		expected.Issuer = v.issuer
+	}
+	if audience != "" {
+		expected.Audience = jwt.Audience{audience}
+	}
+	if err := claims.ValidateWithLeeway(expected, leeway); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %v", err)
+	}
+
+	return &claims, nil
+}
+
+// decode returns the token claims without validating them. The signature is
+// checked when trusted material is configured, the returned flag reports
+// whether it was.
+func (v *tokenVerifier) decode(raw string) (*jwtClaims, bool, error) {
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to parse token: %v", err)
+	}
+
+	var claims jwtClaims
+	if !v.canVerifySignature() {
+		if err := token.UnsafeClaimsWithoutVerification(&claims); err != nil {
+			return nil, false, fmt.Errorf("unable to extract token claims: %v", err)
+		}
+		return &claims, false, nil
+	}
+
+	if err := v.verifySignature(token, &claims); err != nil {
+		return nil, false, err
+	}
+	return &claims, true, nil
+}
+
+// verifySignature checks the signature against each key candidate until one
+// matches.
+func (v *tokenVerifier) verifySignature(token *jwt.JSONWebToken, claims *jwtClaims) error {
+	if len(token.Headers) == 0 {
+		return errors.New("token has no header")
+	}
+
+	for _, key := range v.candidateKeys(token.Headers[0]) {
+		if err := token.Claims(key, claims); err == nil {
+			return nil
+		}
+	}
+
+	return errors.New("unable to verify token signature with the trusted keys")
+}
+
+// candidateKeys returns all trusted public keys that could have signed a
+// token with the given header.
+func (v *tokenVerifier) candidateKeys(h jose.Header) []interface{} {
+	keys := []interface{}{}
+
+	// Certificate chain provided by the token
+	if len(v.certs) > 0 {
+		chains, err := h.Certificates(x509.VerifyOptions{
+			Roots:     v.roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err == nil && len(chains) > 0 {
+			keys = append(keys, chains[0][0].PublicKey)
+		}
+	}
+
+	// Key set lookup
+	if v.keys != nil {
+		if h.KeyID != "" {
+			for _, k := range v.keys.Key(h.KeyID) {
+				keys = append(keys, k.Public().Key)
+			}
+		} else {
+			for _, k := range v.keys.Keys {
+				keys = append(keys, k.Public().Key)
+			}
+		}
+	}
+
+	// Trusted certificates used as signing keys (distribution rootcertbundle)
+	for _, cert := range v.certs {
+		if h.KeyID == "" || h.KeyID == libtrustKeyID(cert.PublicKey) {
+			keys = append(keys, cert.PublicKey)
+		}
+	}
+
+	return keys
+}
+
+// libtrustKeyID computes the key identifier used by docker distribution token
+// servers in the kid header.
+func libtrustKeyID(pub crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+
+	hash := sha256.Sum256(der)
+	encoded := base32.StdEncoding.EncodeToString(hash[:30])
+
+	var sb strings.Builder
+	for i := 0; i < len(encoded); i += 4 {
+		if i > 0 {
+			sb.WriteByte(':')
+		}
+		sb.WriteString(encoded[i : i+4])
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,159 @@
+// Licensed to zntrio under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. zntrio licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package dockerregistry
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/square/go-jose/v3/jwt"
+)
+
+// testCertificate returns a self-signed PEM certificate of the test key.
+func testCertificate(t *testing.T) string {
+	t.Helper()
+
+	key := testSigningKey(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-token-signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestTokenVerifierVerify(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	claims := func(issuer string, expiry time.Time) *jwtClaims {
+		return &jwtClaims{Claims: jwt.Claims{
+			Issuer:   issuer,
+			Audience: jwt.Audience{"test-registry"},
+			IssuedAt: jwt.NewNumericDate(now.Add(-time.Minute)),
+			Expiry:   jwt.NewNumericDate(expiry),
+		}}
+	}
+	valid := signTestToken(t, claims("test-issuer", now.Add(time.Minute)))
+
+	testCases := []struct {
+		name         string
+		certificates string
+		jwks         string
+		issuer       string
+		token        string
+		audience     string
+		leeway       time.Duration
+		wantErr      bool
+	}{
+		{name: "jwks", jwks: testJWKS(t), issuer: "test-issuer", token: valid, audience: "test-registry"},
+		{name: "certificate", certificates: testCertificate(t), token: signTestTokenWith(t, testSigningKey(t), libtrustKeyID(testSigningKey(t).Public()), claims("test-issuer", now.Add(time.Minute))), audience: "test-registry"},
+		{name: "unknown signing key", jwks: testJWKS(t), token: signTestTokenWith(t, otherKey, testKeyID, claims("test-issuer", now.Add(time.Minute))), wantErr: true},
+		{name: "wrong issuer", jwks: testJWKS(t), issuer: "other-issuer", token: valid, wantErr: true},
+		{name: "wrong audience", jwks: testJWKS(t), token: valid, audience: "other-registry", wantErr: true},
+		{name: "expired", jwks: testJWKS(t), token: signTestToken(t, claims("test-issuer", now.Add(-30*time.Second))), wantErr: true},
+		{name: "expired within leeway", jwks: testJWKS(t), token: signTestToken(t, claims("test-issuer", now.Add(-30*time.Second))), leeway: time.Minute},
+		{name: "issuer only", issuer: "test-issuer", token: signTestTokenWith(t, otherKey, testKeyID, claims("test-issuer", now.Add(time.Minute)))},
+		{name: "issuer only mismatch", issuer: "other-issuer", token: valid, wantErr: true},
+		{name: "no verification settings", token: signTestTokenWith(t, otherKey, testKeyID, claims("any-issuer", now.Add(time.Minute)))},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := newTokenVerifier(tc.certificates, tc.jwks, tc.issuer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = v.verify(tc.token, tc.audience, now, tc.leeway)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("verify() error = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenVerifierDecode(t *testing.T) {
+	token := signTestToken(t, &jwtClaims{Claims: jwt.Claims{Issuer: "test-issuer"}})
+
+	var none *tokenVerifier
+	if _, verified, err := none.decode(token); err != nil || verified {
+		t.Fatalf("decode() without verifier = (%v, %v)", verified, err)
+	}
+
+	v, err := newTokenVerifier("", testJWKS(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, verified, err := v.decode(token)
+	if err != nil || !verified {
+		t.Fatalf("decode() with jwks = (%v, %v)", verified, err)
+	}
+	if claims.Issuer != "test-issuer" {
+		t.Fatalf("unexpected issuer %q", claims.Issuer)
+	}
+
+	if _, err := newTokenVerifier("not a certificate", "", ""); err == nil {
+		t.Fatal("expected invalid certificates to be refused")
+	}
+	if _, err := newTokenVerifier("", `{"keys": []}`, ""); err == nil {
+		t.Fatal("expected an empty key set to be refused")
+	}
+}
+
+func TestCredsTokenVerification(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   map[string]interface{}
+		wantCode int
+	}{
+		{name: "trusted signature", config: map[string]interface{}{"jwks": testJWKS(t), "token_issuer": "test-issuer"}},
+		{name: "issuer mismatch", config: map[string]interface{}{"jwks": testJWKS(t), "token_issuer": "other-issuer"}, wantCode: http.StatusInternalServerError},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			b, s, _ := testBackend(t, r, tc.config)
+			testRequest(t, b, s, logical.CreateOperation, "roles/pull", map[string]interface{}{
+				"scopes": []string{"repository:team-a/api:pull"},
+			})
+
+			resp, err := testHandle(b, s, logical.ReadOperation, "creds/pull", nil)
+			if code := testErrorCode(resp, err); code != tc.wantCode {
+				t.Fatalf("expected status %d, got %d: %v", tc.wantCode, code, err)
+			}
+		})
+	}
+}